@@ -0,0 +1,34 @@
+package cache
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrNotFound is returned by Get when a key doesn't exist
+var ErrNotFound = errors.New("cache: key not found")
+
+// Backend stores cache entries and rate limit buckets. Redis is used when
+// it's reachable, with an in-process LRU as the fallback.
+type Backend interface {
+	Name() string
+	Get(key string) ([]byte, error)
+	Set(key string, data []byte, ttl time.Duration) error
+	// SetTagged sets a key and adds it to each tag, see InvalidateTags. If
+	// generations isn't nil the key is only set if the tags still have those
+	// generations, see TagGenerations.
+	SetTagged(key string, data []byte, ttl time.Duration, tags []string, generations []int64) error
+	// InvalidateTags deletes every key added to the tags and moves each tag to a new generation
+	InvalidateTags(tags ...string) error
+	// TagGenerations returns each tag's generation, which changes whenever it's invalidated
+	TagGenerations(tags []string) ([]int64, error)
+	// SetNX sets a key only if it doesn't exist, returning whether it did
+	SetNX(key string, data []byte, ttl time.Duration) (bool, error)
+	// CompareAndDelete deletes a key only if it holds data
+	CompareAndDelete(key string, data []byte) error
+	Delete(keys ...string) error
+	DeletePattern(pattern string) error
+	Exists(key string) bool
+	Increment(key string, ttl time.Duration) (int64, error)
+	TakeToken(key string, capacity int, per time.Duration) (bool, int, time.Duration, error)
+}
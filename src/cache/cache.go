@@ -3,10 +3,12 @@ package cache
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/redis/go-redis/v9"
@@ -15,22 +17,74 @@ import (
 var (
 	client *redis.Client
 	ctx    = context.Background()
+
+	redisBackendImpl *redisBackend
+	memory           = newMemoryBackend(defaultMemorySize)
+	redisHealthy     atomic.Bool
+	stopHealthCheck  = make(chan struct{})
+
+	// Rate limit buckets get their own LRU so they can't evict cached data, or be evicted by it
+	memoryBuckets = newMemoryBackend(defaultMemorySize)
+
+	hits      atomic.Int64
+	misses    atomic.Int64
+	fallbacks atomic.Int64
 )
 
-const DefaultTTL = 3 * time.Hour
+const (
+	DefaultTTL = 3 * time.Hour
 
+	defaultMemorySize     = 10000
+	defaultHealthInterval = 5 * time.Second
+
+	// How long a tag's generation is kept after its last invalidation. Loads
+	// take far less, so one never sees a generation expire under it.
+	tagGenerationTTL = 24 * time.Hour
+)
+
+// Stats describes the cache backend in use and how it's doing
+type Stats struct {
+	Backend      string
+	RedisHealthy bool
+	Hits         int64
+	Misses       int64
+	// Redis errors that sent a request to the in-memory backend
+	Fallbacks     int64
+	MemoryEntries int
+	MemoryBuckets int
+}
+
+// Init connects to Redis and starts checking its health in the background.
+// An error means Redis isn't reachable yet; the in-memory backend is used
+// until it is.
 func Init() error {
 	host := getEnv("REDIS_HOST", "redis")
 	port := getEnv("REDIS_PORT", "6379")
 	db, _ := strconv.Atoi(getEnv("REDIS_DB", "0"))
 
+	if size, err := strconv.Atoi(getEnv("CACHE_MEMORY_SIZE", "")); err == nil && size > 0 {
+		memory = newMemoryBackend(size)
+	}
+	if size, err := strconv.Atoi(getEnv("RATE_LIMIT_MEMORY_SIZE", "")); err == nil && size > 0 {
+		memoryBuckets = newMemoryBackend(size)
+	}
+
+	interval := defaultHealthInterval
+	if d, err := time.ParseDuration(getEnv("REDIS_HEALTH_INTERVAL", "")); err == nil && d > 0 {
+		interval = d
+	}
+
 	client = redis.NewClient(&redis.Options{
 		Addr: fmt.Sprintf("%s:%s", host, port),
 		DB:   db,
 	})
+	redisBackendImpl = &redisBackend{client: client}
 
-	// Test connection
-	if err := client.Ping(ctx).Err(); err != nil {
+	err := client.Ping(ctx).Err()
+	redisHealthy.Store(err == nil)
+	go healthCheck(interval)
+
+	if err != nil {
 		return fmt.Errorf("failed to connect to redis: %w", err)
 	}
 
@@ -40,12 +94,79 @@ func Init() error {
 
 func Close() {
 	if client != nil {
+		close(stopHealthCheck)
 		client.Close()
 	}
 }
 
+// healthCheck pings Redis on an interval, switching between it and the
+// in-memory backend as it goes down and comes back. The in-memory backend is
+// flushed when it takes over, and Redis is sent the writes it missed before
+// it does.
+func healthCheck(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopHealthCheck:
+			return
+		case <-ticker.C:
+			err := client.Ping(ctx).Err()
+			if err != nil {
+				if redisHealthy.Swap(false) {
+					memory.Flush()
+					slog.Warn("Redis is unavailable, using the in-memory cache", "error", err)
+				}
+				continue
+			}
+			if redisHealthy.Load() {
+				continue
+			}
+
+			if err := replayMissed(); err != nil {
+				slog.Warn("Couldn't apply writes Redis missed, staying on the in-memory cache", "error", err)
+				continue
+			}
+			redisHealthy.Store(true)
+			// Catch writes that went to memory while the first replay ran
+			if err := replayMissed(); err != nil {
+				markUnhealthy(err)
+				continue
+			}
+			slog.Info("Redis is back, switching from the in-memory cache")
+		}
+	}
+}
+
+// markUnhealthy switches to the in-memory backend after a Redis error, until
+// the next health check succeeds
+func markUnhealthy(err error) {
+	fallbacks.Add(1)
+	if redisHealthy.Swap(false) {
+		memory.Flush()
+		slog.Warn("Redis request failed, using the in-memory cache", "error", err)
+	}
+}
+
+// active returns the backend requests should go to
+func active() Backend {
+	if redisBackendImpl != nil && redisHealthy.Load() {
+		return redisBackendImpl
+	}
+	return memory
+}
+
+// check passes through a backend's error, noting Redis failures
+func check(b Backend, err error) error {
+	if err != nil && !errors.Is(err, ErrNotFound) && b != memory {
+		markUnhealthy(err)
+	}
+	return err
+}
+
 func Set(key string, value any) error {
-	return SetWithTTL(key, value, DefaultTTL)
+	return SetWithTTL(key, value, jitter(DefaultTTL))
 }
 
 func SetWithTTL(key string, value any, ttl time.Duration) error {
@@ -54,64 +175,89 @@ func SetWithTTL(key string, value any, ttl time.Duration) error {
 		return err
 	}
 
-	return client.Set(ctx, key, data, ttl).Err()
+	b := active()
+	err = b.Set(key, data, ttl)
+	recordMissed(b, err, missed.keys, key)
+	return check(b, err)
 }
 
-func Get(key string, dest any) error {
-	data, err := client.Get(ctx, key).Bytes()
+// SetTagged sets a key like SetWithTTL and adds it to tags, so it can be
+// deleted along with everything else about a deck or user by InvalidateTags
+func SetTagged(key string, value any, ttl time.Duration, tags ...string) error {
+	data, err := json.Marshal(value)
 	if err != nil {
 		return err
 	}
 
+	b := active()
+	err = b.SetTagged(key, data, ttl, tags, nil)
+	recordMissed(b, err, missed.keys, key)
+	return check(b, err)
+}
+
+// InvalidateTags deletes every key set with any of the tags
+func InvalidateTags(tags ...string) error {
+	b := active()
+	err := b.InvalidateTags(tags...)
+	recordMissed(b, err, missed.tags, tags...)
+	return check(b, err)
+}
+
+func Get(key string, dest any) error {
+	b := active()
+	data, err := b.Get(key)
+	if err != nil {
+		misses.Add(1)
+		return check(b, err)
+	}
+
+	hits.Add(1)
 	return json.Unmarshal(data, dest)
 }
 
 func Delete(key string) error {
-	return client.Del(ctx, key).Err()
+	b := active()
+	err := b.Delete(key)
+	recordMissed(b, err, missed.keys, key)
+	return check(b, err)
 }
 
 func DeletePattern(pattern string) error {
-	keys, err := client.Keys(ctx, pattern).Result()
-	if err != nil {
-		return err
-	}
-	if len(keys) > 0 {
-		return client.Del(ctx, keys...).Err()
-	}
-	return nil
+	b := active()
+	err := b.DeletePattern(pattern)
+	recordMissed(b, err, missed.patterns, pattern)
+	return check(b, err)
 }
 
 func Exists(key string) bool {
-	result, err := client.Exists(ctx, key).Result()
-	return err == nil && result > 0
+	return active().Exists(key)
 }
 
-// IsAvailable returns true if Redis is connected and available
+// IsAvailable returns true if Redis passed its last health check. The
+// in-memory backend is used when it didn't.
 func IsAvailable() bool {
-	if client == nil {
-		return false
-	}
-	return client.Ping(ctx).Err() == nil
+	return redisBackendImpl != nil && redisHealthy.Load()
 }
 
 // Increment increments a key and sets expiry if it's a new key
 // Returns the new count after incrementing
 func Increment(key string, ttl time.Duration) (int64, error) {
-	if client == nil {
-		return 0, fmt.Errorf("redis client not initialized")
-	}
-
-	count, err := client.Incr(ctx, key).Result()
-	if err != nil {
-		return 0, err
-	}
+	b := active()
+	count, err := b.Increment(key, ttl)
+	return count, check(b, err)
+}
 
-	// If this is the first increment (count == 1), set the expiry
-	if count == 1 {
-		client.Expire(ctx, key, ttl)
+// GetStats returns the active backend and hit counts since startup
+func GetStats() Stats {
+	return Stats{
+		Backend:       active().Name(),
+		RedisHealthy:  IsAvailable(),
+		Hits:          hits.Load(),
+		Misses:        misses.Load(),
+		Fallbacks:     fallbacks.Load(),
+		MemoryEntries: memory.Len(),
+		MemoryBuckets: memoryBuckets.Len(),
 	}
-
-	return count, nil
 }
 
 func UserKey(userID int) string {
@@ -126,6 +272,10 @@ func UserDecksKey(userID int) string {
 	return fmt.Sprintf("user:%d:decks", userID)
 }
 
+func PublicDecksKey() string {
+	return "decks:public"
+}
+
 func DeckCardsKey(deckID int) string {
 	return fmt.Sprintf("deck:%d:cards", deckID)
 }
@@ -134,6 +284,33 @@ func CardKey(cardID int) string {
 	return fmt.Sprintf("card:%d", cardID)
 }
 
+func SessionKey(familyID string) string {
+	return fmt.Sprintf("session:%s", familyID)
+}
+
+// DeckTag tags keys holding anything about a deck or its cards
+func DeckTag(deckID int) string {
+	return fmt.Sprintf("deck:%d", deckID)
+}
+
+// UserTag tags keys holding anything about a user's data
+func UserTag(userID int) string {
+	return fmt.Sprintf("user:%d", userID)
+}
+
+// PublicDecksTag tags the list of public decks
+func PublicDecksTag() string {
+	return "decks:public"
+}
+
+func tagKey(tag string) string {
+	return "tag:" + tag
+}
+
+func tagGenerationKey(tag string) string {
+	return tagKey(tag) + ":gen"
+}
+
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
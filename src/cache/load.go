@@ -0,0 +1,247 @@
+package cache
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	mrand "math/rand/v2"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// How long one server gets to load a key before others stop waiting for it
+	loadLockTTL = 5 * time.Second
+	// How often servers waiting on another's load check whether it's done
+	loadPollInterval = 50 * time.Millisecond
+
+	defaultTTLJitter = 0.1
+)
+
+// LoadOptions controls how GetOrLoad caches a value
+type LoadOptions struct {
+	// How long the value is kept, DefaultTTL if zero. Jittered so keys
+	// cached together don't all expire together.
+	TTL time.Duration
+	// After SoftTTL the value is stale: it's still returned, but one caller
+	// reloads it in the background. Zero means values are never stale.
+	SoftTTL time.Duration
+	// Tags the key is added to, see InvalidateTags
+	Tags []string
+}
+
+// loadedValue is what GetOrLoad stores, the value plus when it goes stale
+type loadedValue struct {
+	Value      json.RawMessage `json:"v"`
+	StaleAfter int64           `json:"s,omitempty"`
+}
+
+var (
+	loads       flightGroup
+	refreshes   flightGroup
+	ttlJitter   float64
+	jitterOnce  sync.Once
+	errLoadBusy = errors.New("cache: key is being loaded")
+)
+
+// GetOrLoad returns the value cached at key, calling load to fill the cache
+// on a miss. Only one caller per process loads a key at a time, and a short
+// lock in Redis stops other servers loading it too while one already is.
+func GetOrLoad[T any](key string, opts LoadOptions, load func() (T, error)) (T, error) {
+	var value T
+
+	data, err := getOrLoad(key, opts, func() ([]byte, error) {
+		v, err := load()
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(v)
+	})
+	if err != nil {
+		return value, err
+	}
+
+	err = json.Unmarshal(data, &value)
+	return value, err
+}
+
+func getOrLoad(key string, opts LoadOptions, load func() ([]byte, error)) ([]byte, error) {
+	if cached, ok := getLoaded(key); ok {
+		if cached.StaleAfter != 0 && time.Now().UnixMilli() > cached.StaleAfter {
+			go func() {
+				defer func() {
+					if r := recover(); r != nil {
+						slog.Error("Panic refreshing cached value", "key", key, "panic", r)
+					}
+				}()
+				refreshes.do(key, func() ([]byte, error) {
+					data, err := loadWithLock(key, opts, load, false)
+					if err != nil && !errors.Is(err, errLoadBusy) {
+						slog.Warn("Failed to refresh cached value", "key", key, "error", err)
+					}
+					return data, err
+				})
+			}()
+		}
+		return cached.Value, nil
+	}
+
+	return loads.do(key, func() ([]byte, error) {
+		return loadWithLock(key, opts, load, true)
+	})
+}
+
+// loadWithLock loads and caches a key if no other server is loading it. If
+// one is and wait is set, it waits for that server's result instead, only
+// loading the key itself if it doesn't turn up. What's loaded isn't cached if
+// any of its tags were invalidated during the load, since it may predate the
+// write that invalidated them.
+func loadWithLock(key string, opts LoadOptions, load func() ([]byte, error), wait bool) ([]byte, error) {
+	lock := loadLockKey(key)
+	token, locked := acquireLock(lock)
+	if !locked {
+		if !wait {
+			return nil, errLoadBusy
+		}
+		for deadline := time.Now().Add(loadLockTTL); time.Now().Before(deadline); {
+			time.Sleep(loadPollInterval)
+			if cached, ok := getLoaded(key); ok {
+				return cached.Value, nil
+			}
+		}
+	} else {
+		defer releaseLock(lock, token)
+	}
+
+	b := active()
+	generations, err := b.TagGenerations(opts.Tags)
+	if err != nil {
+		check(b, err)
+		return load()
+	}
+
+	data, err := load()
+	if err != nil {
+		return nil, err
+	}
+
+	ttl := opts.TTL
+	if ttl == 0 {
+		ttl = DefaultTTL
+	}
+	factor := jitterFactor()
+	stored := loadedValue{Value: data}
+	if opts.SoftTTL > 0 {
+		stored.StaleAfter = time.Now().Add(time.Duration(float64(opts.SoftTTL) * factor)).UnixMilli()
+	}
+
+	encoded, err := json.Marshal(stored)
+	if err == nil {
+		check(b, b.SetTagged(key, encoded, time.Duration(float64(ttl)*factor), opts.Tags, generations))
+	}
+	return data, nil
+}
+
+func getLoaded(key string) (loadedValue, bool) {
+	var cached loadedValue
+	b := active()
+	data, err := b.Get(key)
+	if err != nil {
+		misses.Add(1)
+		check(b, err)
+		return cached, false
+	}
+	if err := json.Unmarshal(data, &cached); err != nil {
+		misses.Add(1)
+		return cached, false
+	}
+	hits.Add(1)
+	return cached, true
+}
+
+// acquireLock takes a lock for loadLockTTL. If the backend fails the lock is
+// treated as taken by us, since the in-process flight group still applies.
+func acquireLock(lock string) (string, bool) {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	token := hex.EncodeToString(buf)
+
+	b := active()
+	ok, err := b.SetNX(lock, []byte(token), loadLockTTL)
+	if err != nil {
+		check(b, err)
+		return token, true
+	}
+	return token, ok
+}
+
+func releaseLock(lock, token string) {
+	b := active()
+	check(b, b.CompareAndDelete(lock, []byte(token)))
+}
+
+func loadLockKey(key string) string {
+	return "lock:" + key
+}
+
+// jitterFactor returns a random multiplier for TTLs within CACHE_TTL_JITTER
+// (a fraction, 0.1 by default) either side of 1
+func jitterFactor() float64 {
+	jitterOnce.Do(func() {
+		ttlJitter = defaultTTLJitter
+		if value := getEnv("CACHE_TTL_JITTER", ""); value != "" {
+			j, err := strconv.ParseFloat(value, 64)
+			if err != nil || j < 0 || j >= 1 {
+				slog.Warn("Invalid CACHE_TTL_JITTER, using the default", "value", value)
+			} else {
+				ttlJitter = j
+			}
+		}
+	})
+	return 1 + ttlJitter*(2*mrand.Float64()-1)
+}
+
+// jitter spreads out a TTL, see jitterFactor
+func jitter(ttl time.Duration) time.Duration {
+	return time.Duration(float64(ttl) * jitterFactor())
+}
+
+// flightGroup makes concurrent calls for the same key share one result
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flight
+}
+
+type flight struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+func (g *flightGroup) do(key string, fn func() ([]byte, error)) ([]byte, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flight)
+	}
+	if f, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		<-f.done
+		return f.data, f.err
+	}
+	f := &flight{done: make(chan struct{}), err: errors.New("cache: load panicked")}
+	g.calls[key] = f
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(f.done)
+	}()
+
+	f.data, f.err = fn()
+	return f.data, f.err
+}
@@ -0,0 +1,318 @@
+package cache
+
+import (
+	"container/list"
+	"math"
+	"path"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// memoryBackend is an in-process LRU used while Redis is unreachable. It
+// isn't shared between app servers, so limits and cached data are per process.
+// Rate limit buckets are kept in a separate instance, memoryBuckets.
+type memoryBackend struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+	// Keys added to each tag by SetTagged
+	tags map[string]map[string]struct{}
+	// Generations of invalidated tags, numbered from one counter so a tag
+	// never gets a generation it had before
+	generations    map[string]tagGeneration
+	lastGeneration int64
+}
+
+type tagGeneration struct {
+	n       int64
+	expires time.Time
+}
+
+type memoryEntry struct {
+	key     string
+	data    []byte
+	expires time.Time
+	tags    []string
+
+	// Token bucket state, for entries made by TakeToken
+	tokens float64
+	ts     time.Time
+}
+
+func newMemoryBackend(size int) *memoryBackend {
+	return &memoryBackend{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+		tags:    make(map[string]map[string]struct{}),
+
+		generations: make(map[string]tagGeneration),
+	}
+}
+
+func (b *memoryBackend) Name() string {
+	return "memory"
+}
+
+// lookup returns a live entry and marks it recently used. Callers hold b.mu.
+func (b *memoryBackend) lookup(key string) *memoryEntry {
+	el, ok := b.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := el.Value.(*memoryEntry)
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		b.remove(el)
+		return nil
+	}
+	b.order.MoveToFront(el)
+	return entry
+}
+
+// store adds or replaces an entry, evicting the least recently used one if
+// the cache is full. Callers hold b.mu.
+func (b *memoryBackend) store(entry *memoryEntry) {
+	if el, ok := b.entries[entry.key]; ok {
+		b.untag(el.Value.(*memoryEntry))
+		el.Value = entry
+		b.order.MoveToFront(el)
+		b.tag(entry)
+		return
+	}
+	b.tag(entry)
+	b.entries[entry.key] = b.order.PushFront(entry)
+	for b.order.Len() > b.size {
+		b.remove(b.order.Back())
+	}
+}
+
+func (b *memoryBackend) remove(el *list.Element) {
+	entry := el.Value.(*memoryEntry)
+	b.untag(entry)
+	b.order.Remove(el)
+	delete(b.entries, entry.key)
+}
+
+func (b *memoryBackend) tag(entry *memoryEntry) {
+	for _, tag := range entry.tags {
+		if b.tags[tag] == nil {
+			b.tags[tag] = make(map[string]struct{})
+		}
+		b.tags[tag][entry.key] = struct{}{}
+	}
+}
+
+func (b *memoryBackend) untag(entry *memoryEntry) {
+	for _, tag := range entry.tags {
+		delete(b.tags[tag], entry.key)
+		if len(b.tags[tag]) == 0 {
+			delete(b.tags, tag)
+		}
+	}
+}
+
+func (b *memoryBackend) Get(key string) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	entry := b.lookup(key)
+	if entry == nil || entry.data == nil {
+		return nil, ErrNotFound
+	}
+	return entry.data, nil
+}
+
+func (b *memoryBackend) Set(key string, data []byte, ttl time.Duration) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.store(&memoryEntry{key: key, data: data, expires: expiry(ttl)})
+	return nil
+}
+
+func (b *memoryBackend) SetTagged(key string, data []byte, ttl time.Duration, tags []string, generations []int64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if generations != nil && !slices.Equal(b.tagGenerations(tags), generations) {
+		return nil
+	}
+	b.store(&memoryEntry{key: key, data: data, expires: expiry(ttl), tags: tags})
+	return nil
+}
+
+func (b *memoryBackend) InvalidateTags(tags ...string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if len(b.generations) > b.size {
+		for tag, generation := range b.generations {
+			if now.After(generation.expires) {
+				delete(b.generations, tag)
+			}
+		}
+	}
+
+	for _, tag := range tags {
+		b.lastGeneration++
+		b.generations[tag] = tagGeneration{n: b.lastGeneration, expires: now.Add(tagGenerationTTL)}
+
+		for key := range b.tags[tag] {
+			if el, ok := b.entries[key]; ok {
+				b.remove(el)
+			}
+		}
+		delete(b.tags, tag)
+	}
+	return nil
+}
+
+// Flush drops every entry. Tag generations are kept, so a load that started
+// before the flush still can't store data from before a later invalidation.
+func (b *memoryBackend) Flush() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.order.Init()
+	clear(b.entries)
+	clear(b.tags)
+}
+
+func (b *memoryBackend) TagGenerations(tags []string) ([]int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.tagGenerations(tags), nil
+}
+
+// tagGenerations returns each tag's generation, 0 if it hasn't been
+// invalidated lately. Callers hold b.mu.
+func (b *memoryBackend) tagGenerations(tags []string) []int64 {
+	now := time.Now()
+	generations := make([]int64, len(tags))
+	for i, tag := range tags {
+		if generation, ok := b.generations[tag]; ok && !now.After(generation.expires) {
+			generations[i] = generation.n
+		}
+	}
+	return generations
+}
+
+func (b *memoryBackend) SetNX(key string, data []byte, ttl time.Duration) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.lookup(key) != nil {
+		return false, nil
+	}
+	b.store(&memoryEntry{key: key, data: data, expires: expiry(ttl)})
+	return true, nil
+}
+
+func (b *memoryBackend) CompareAndDelete(key string, data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if entry := b.lookup(key); entry != nil && string(entry.data) == string(data) {
+		b.remove(b.entries[key])
+	}
+	return nil
+}
+
+func (b *memoryBackend) Delete(keys ...string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, key := range keys {
+		if el, ok := b.entries[key]; ok {
+			b.remove(el)
+		}
+	}
+	return nil
+}
+
+// DeletePattern deletes keys matching a glob pattern, like Redis' KEYS
+func (b *memoryBackend) DeletePattern(pattern string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for key, el := range b.entries {
+		if matched, _ := path.Match(pattern, key); matched {
+			b.remove(el)
+		}
+	}
+	return nil
+}
+
+func (b *memoryBackend) Exists(key string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.lookup(key) != nil
+}
+
+func (b *memoryBackend) Increment(key string, ttl time.Duration) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	entry := b.lookup(key)
+	if entry == nil {
+		entry = &memoryEntry{key: key, expires: expiry(ttl)}
+	}
+	count, _ := strconv.ParseInt(string(entry.data), 10, 64)
+	count++
+	entry.data = []byte(strconv.FormatInt(count, 10))
+	b.store(entry)
+	return count, nil
+}
+
+// TakeToken works the same way as the Redis token bucket script
+func (b *memoryBackend) TakeToken(key string, capacity int, per time.Duration) (bool, int, time.Duration, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	rate := float64(capacity) / per.Seconds()
+
+	entry := b.lookup(key)
+	if entry == nil {
+		entry = &memoryEntry{key: key, tokens: float64(capacity), ts: now}
+	}
+
+	tokens := math.Min(float64(capacity), entry.tokens+math.Max(0, now.Sub(entry.ts).Seconds())*rate)
+
+	allowed := false
+	var wait time.Duration
+	if tokens >= 1 {
+		tokens--
+		allowed = true
+	} else {
+		wait = time.Duration(math.Ceil((1-tokens)/rate*1000)) * time.Millisecond
+	}
+
+	entry.tokens = tokens
+	entry.ts = now
+	entry.expires = now.Add(per)
+	b.store(entry)
+
+	return allowed, int(tokens), wait, nil
+}
+
+// Len returns the number of entries, including expired ones not yet evicted
+func (b *memoryBackend) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.order.Len()
+}
+
+func expiry(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(ttl)
+}
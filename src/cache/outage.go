@@ -0,0 +1,94 @@
+package cache
+
+import (
+	"errors"
+	"sync"
+)
+
+// Writes made while Redis is down only reach the in-memory backend, so Redis
+// would serve what they replaced once it's back. They're recorded here and
+// applied to Redis before switching back to it.
+var missed = struct {
+	mu       sync.Mutex
+	keys     map[string]struct{}
+	tags     map[string]struct{}
+	patterns map[string]struct{}
+	// Set when more than maxMissed were recorded, and everything is flushed instead
+	overflowed bool
+}{
+	keys:     make(map[string]struct{}),
+	tags:     make(map[string]struct{}),
+	patterns: make(map[string]struct{}),
+}
+
+const maxMissed = 10000
+
+// cachedPatterns match every key the cache stores, apart from rate limit
+// buckets. They're deleted on recovery if too many writes were missed.
+var cachedPatterns = []string{"user:*", "deck:*", "decks:*", "card:*", "session:*", "tag:*"}
+
+// recordMissed notes a write that didn't reach Redis. b and err are what the
+// write went to and returned.
+func recordMissed(b Backend, err error, set map[string]struct{}, names ...string) {
+	if redisBackendImpl == nil || (b != memory && err == nil) {
+		return
+	}
+
+	missed.mu.Lock()
+	defer missed.mu.Unlock()
+
+	if missed.overflowed {
+		return
+	}
+	for _, name := range names {
+		set[name] = struct{}{}
+	}
+	if len(missed.keys)+len(missed.tags)+len(missed.patterns) > maxMissed {
+		clear(missed.keys)
+		clear(missed.tags)
+		clear(missed.patterns)
+		missed.overflowed = true
+	}
+}
+
+// replayMissed applies the writes Redis missed. Anything that couldn't be
+// applied stays recorded for the next attempt.
+func replayMissed() error {
+	missed.mu.Lock()
+	defer missed.mu.Unlock()
+
+	r := redisBackendImpl
+	if missed.overflowed {
+		for _, pattern := range cachedPatterns {
+			if err := r.DeletePattern(pattern); err != nil {
+				return err
+			}
+		}
+		missed.overflowed = false
+		return nil
+	}
+
+	var errs []error
+	for tag := range missed.tags {
+		if err := r.InvalidateTags(tag); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		delete(missed.tags, tag)
+	}
+	for key := range missed.keys {
+		if err := r.Delete(key); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		delete(missed.keys, key)
+	}
+	for pattern := range missed.patterns {
+		if err := r.DeletePattern(pattern); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		delete(missed.patterns, pattern)
+	}
+	return errors.Join(errs...)
+}
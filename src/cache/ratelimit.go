@@ -0,0 +1,27 @@
+package cache
+
+import (
+	"fmt"
+	"time"
+)
+
+// TakeToken takes a token from a bucket holding up to capacity tokens that
+// refills completely every per. It returns whether a token was available, how
+// many are left and, if none were, how long until the next one. If Redis
+// fails the in-memory limiter is used, so limits are never skipped.
+func TakeToken(key string, capacity int, per time.Duration) (bool, int, time.Duration, error) {
+	if b := active(); b != memory {
+		allowed, remaining, wait, err := b.TakeToken(key, capacity, per)
+		if err == nil {
+			return allowed, remaining, wait, nil
+		}
+		markUnhealthy(err)
+	}
+	return memoryBuckets.TakeToken(key, capacity, per)
+}
+
+// RateLimitKey names the bucket for a route, policy and user or IP. The
+// policy is part of the key so stacked limiters on a route don't share a bucket.
+func RateLimitKey(route, policy, subject string) string {
+	return fmt.Sprintf("ratelimit:%s:%s:%s", route, policy, subject)
+}
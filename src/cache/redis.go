@@ -0,0 +1,273 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// How many keys SCAN and SSCAN are asked for at a time, and so the most
+// deleted by one UNLINK
+const scanBatch = 500
+
+// errStaleGeneration aborts a SetTagged whose tags have been invalidated
+var errStaleGeneration = errors.New("cache: tag generation changed")
+
+type redisBackend struct {
+	client *redis.Client
+}
+
+func (b *redisBackend) Name() string {
+	return "redis"
+}
+
+func (b *redisBackend) Get(key string) ([]byte, error) {
+	data, err := b.client.Get(ctx, key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+func (b *redisBackend) Set(key string, data []byte, ttl time.Duration) error {
+	return b.client.Set(ctx, key, data, ttl).Err()
+}
+
+func (b *redisBackend) SetNX(key string, data []byte, ttl time.Duration) (bool, error) {
+	return b.client.SetNX(ctx, key, data, ttl).Result()
+}
+
+var compareAndDeleteScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+func (b *redisBackend) CompareAndDelete(key string, data []byte) error {
+	return compareAndDeleteScript.Run(ctx, b.client, []string{key}, data).Err()
+}
+
+// Delete uses UNLINK so large values are freed off Redis' main thread
+func (b *redisBackend) Delete(keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	return b.client.Unlink(ctx, keys...).Err()
+}
+
+// DeletePattern walks the keyspace with SCAN rather than KEYS, which would
+// block Redis until it had looked at every key
+func (b *redisBackend) DeletePattern(pattern string) error {
+	var cursor uint64
+	for {
+		keys, next, err := b.client.Scan(ctx, cursor, pattern, scanBatch).Result()
+		if err != nil {
+			return err
+		}
+		if err := b.Delete(keys...); err != nil {
+			return err
+		}
+		if cursor = next; cursor == 0 {
+			return nil
+		}
+	}
+}
+
+// SetTagged watches the tags' generations when it's given them, so the set is
+// dropped if a tag is invalidated between checking them and setting the key
+func (b *redisBackend) SetTagged(key string, data []byte, ttl time.Duration, tags []string, generations []int64) error {
+	set := func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, key, data, ttl)
+		for _, tag := range tags {
+			pipe.SAdd(ctx, tagKey(tag), key)
+			// A tag lives as long as its longest-lived key
+			if ttl > 0 {
+				pipe.ExpireNX(ctx, tagKey(tag), ttl)
+				pipe.ExpireGT(ctx, tagKey(tag), ttl)
+			}
+		}
+		return nil
+	}
+	if generations == nil || len(tags) == 0 {
+		_, err := b.client.TxPipelined(ctx, set)
+		return err
+	}
+
+	keys := tagGenerationKeys(tags)
+	err := b.client.Watch(ctx, func(tx *redis.Tx) error {
+		values, err := tx.MGet(ctx, keys...).Result()
+		if err != nil {
+			return err
+		}
+		if !slices.Equal(parseGenerations(values), generations) {
+			return errStaleGeneration
+		}
+		_, err = tx.TxPipelined(ctx, set)
+		return err
+	}, keys...)
+	if errors.Is(err, errStaleGeneration) || errors.Is(err, redis.TxFailedErr) {
+		return nil
+	}
+	return err
+}
+
+func (b *redisBackend) TagGenerations(tags []string) ([]int64, error) {
+	if len(tags) == 0 {
+		return []int64{}, nil
+	}
+	values, err := b.client.MGet(ctx, tagGenerationKeys(tags)...).Result()
+	if err != nil {
+		return nil, err
+	}
+	return parseGenerations(values), nil
+}
+
+func tagGenerationKeys(tags []string) []string {
+	keys := make([]string, len(tags))
+	for i, tag := range tags {
+		keys[i] = tagGenerationKey(tag)
+	}
+	return keys
+}
+
+// parseGenerations reads MGET results, a missing generation being 0
+func parseGenerations(values []any) []int64 {
+	generations := make([]int64, len(values))
+	for i, value := range values {
+		if s, ok := value.(string); ok {
+			generations[i], _ = strconv.ParseInt(s, 10, 64)
+		}
+	}
+	return generations
+}
+
+// renameIfExistsScript renames KEYS[1] to KEYS[2], returning 0 rather than
+// an error if there's nothing to rename
+var renameIfExistsScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+redis.call('RENAME', KEYS[1], KEYS[2])
+return 1
+`)
+
+// InvalidateTags bumps each tag's generation first, so loads already under way
+// don't store what they read. Then it renames each tag's set before deleting
+// its keys, so keys tagged while that's going on land in a fresh set and
+// aren't lost track of.
+func (b *redisBackend) InvalidateTags(tags ...string) error {
+	_, err := b.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, tag := range tags {
+			pipe.Incr(ctx, tagGenerationKey(tag))
+			pipe.Expire(ctx, tagGenerationKey(tag), tagGenerationTTL)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, tag := range tags {
+		pending := fmt.Sprintf("%s:invalidating:%d", tagKey(tag), time.Now().UnixNano())
+		renamed, err := renameIfExistsScript.Run(ctx, b.client, []string{tagKey(tag), pending}).Int()
+		if err != nil {
+			return err
+		}
+		if renamed == 0 {
+			continue
+		}
+
+		var cursor uint64
+		for {
+			keys, next, err := b.client.SScan(ctx, pending, cursor, "", scanBatch).Result()
+			if err != nil {
+				return err
+			}
+			if err := b.Delete(keys...); err != nil {
+				return err
+			}
+			if cursor = next; cursor == 0 {
+				break
+			}
+		}
+		if err := b.Delete(pending); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *redisBackend) Exists(key string) bool {
+	result, err := b.client.Exists(ctx, key).Result()
+	return err == nil && result > 0
+}
+
+// Increment increments a key and sets expiry if it's a new key
+func (b *redisBackend) Increment(key string, ttl time.Duration) (int64, error) {
+	count, err := b.client.Incr(ctx, key).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	// If this is the first increment (count == 1), set the expiry
+	if count == 1 {
+		b.client.Expire(ctx, key, ttl)
+	}
+
+	return count, nil
+}
+
+// tokenBucketScript atomically refills a bucket for the time since it was
+// last used and takes one token if there is one. Redis' clock is used so
+// app servers with skewed clocks share buckets fairly.
+//
+// Returns {allowed, tokens left, milliseconds until a token is available}.
+var tokenBucketScript = redis.NewScript(`
+local capacity = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+
+local time = redis.call('TIME')
+local now = tonumber(time[1]) + tonumber(time[2]) / 1000000
+
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(bucket[1])
+local ts = tonumber(bucket[2])
+if tokens == nil or ts == nil then
+	tokens = capacity
+	ts = now
+end
+
+tokens = math.min(capacity, tokens + math.max(0, now - ts) * rate)
+
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	wait = math.ceil((1 - tokens) / rate * 1000)
+end
+
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', tostring(now))
+redis.call('PEXPIRE', KEYS[1], math.ceil(capacity / rate * 1000))
+
+return {allowed, math.floor(tokens), wait}
+`)
+
+func (b *redisBackend) TakeToken(key string, capacity int, per time.Duration) (bool, int, time.Duration, error) {
+	rate := float64(capacity) / per.Seconds()
+	result, err := tokenBucketScript.Run(ctx, b.client, []string{key}, capacity, rate).Int64Slice()
+	if err != nil {
+		return false, 0, 0, err
+	}
+	if len(result) != 3 {
+		return false, 0, 0, fmt.Errorf("unexpected token bucket result %v", result)
+	}
+
+	return result[0] == 1, int(result[1]), time.Duration(result[2]) * time.Millisecond, nil
+}
@@ -0,0 +1,256 @@
+// Command mockidp is a minimal OpenID Connect provider for trying out single
+// sign-on locally. It signs in whoever types an email address, so never
+// expose it anywhere that matters.
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"html/template"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const keyID = "mockidp-1"
+
+// authCode is an issued authorization code waiting to be redeemed
+type authCode struct {
+	clientID    string
+	redirectURI string
+	nonce       string
+	challenge   string
+	email       string
+	verified    bool
+	expiresAt   time.Time
+}
+
+type server struct {
+	issuer       string
+	publicURL    string
+	clientID     string
+	clientSecret string
+	key          *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]authCode
+}
+
+var loginPage = template.Must(template.New("login").Parse(`<!doctype html>
+<title>Mock identity provider</title>
+<h1>Mock identity provider</h1>
+<form method="post">
+  {{range $k, $v := .Params}}<input type="hidden" name="{{$k}}" value="{{index $v 0}}">{{end}}
+  <label>Email <input name="email" type="email" value="{{.Email}}" required autofocus></label>
+  <label><input name="email_verified" type="checkbox" value="true" checked> Email verified</label>
+  <button>Sign in</button>
+</form>
+`))
+
+func main() {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		slog.Error("Failed to generate signing key", "error", err)
+		os.Exit(1)
+	}
+
+	port := getEnv("MOCK_IDP_PORT", "9090")
+	issuer := strings.TrimSuffix(getEnv("MOCK_IDP_ISSUER", "http://127.0.0.1:"+port), "/")
+	s := &server{
+		issuer: issuer,
+		// The browser may need a different address than the backend, e.g. under docker compose
+		publicURL:    strings.TrimSuffix(getEnv("MOCK_IDP_PUBLIC_URL", issuer), "/"),
+		clientID:     getEnv("MOCK_IDP_CLIENT_ID", "quizzler"),
+		clientSecret: getEnv("MOCK_IDP_CLIENT_SECRET", ""),
+		key:          key,
+		codes:        make(map[string]authCode),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", s.discovery)
+	mux.HandleFunc("GET /jwks", s.jwks)
+	mux.HandleFunc("GET /authorize", s.authorizeForm)
+	mux.HandleFunc("POST /authorize", s.authorize)
+	mux.HandleFunc("POST /token", s.token)
+
+	slog.Info("Mock identity provider starting", "issuer", s.issuer, "client_id", s.clientID, "port", port)
+	if err := http.ListenAndServe(":"+port, mux); err != nil {
+		slog.Error("Failed to listen", "error", err)
+		os.Exit(1)
+	}
+}
+
+func (s *server) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"issuer":                                s.issuer,
+		"authorization_endpoint":                s.publicURL + "/authorize",
+		"token_endpoint":                        s.issuer + "/token",
+		"jwks_uri":                              s.issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"scopes_supported":                      []string{"openid", "email", "profile"},
+	})
+}
+
+func (s *server) jwks(w http.ResponseWriter, r *http.Request) {
+	pub := s.key.PublicKey
+	writeJSON(w, http.StatusOK, map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": keyID,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
+
+func (s *server) authorizeForm(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != s.clientID || q.Get("response_type") != "code" || q.Get("redirect_uri") == "" {
+		http.Error(w, "invalid authorization request", http.StatusBadRequest)
+		return
+	}
+	if q.Get("code_challenge") == "" || q.Get("code_challenge_method") != "S256" {
+		http.Error(w, "PKCE with S256 is required", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	loginPage.Execute(w, map[string]any{
+		"Params": q,
+		"Email":  getEnv("MOCK_IDP_EMAIL", "user@example.com"),
+	})
+}
+
+func (s *server) authorize(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "invalid form", http.StatusBadRequest)
+		return
+	}
+
+	redirectURI, err := url.Parse(r.PostForm.Get("redirect_uri"))
+	if err != nil || r.PostForm.Get("client_id") != s.clientID {
+		http.Error(w, "invalid authorization request", http.StatusBadRequest)
+		return
+	}
+
+	code := randomString()
+	s.mu.Lock()
+	s.codes[code] = authCode{
+		clientID:    s.clientID,
+		redirectURI: redirectURI.String(),
+		nonce:       r.PostForm.Get("nonce"),
+		challenge:   r.PostForm.Get("code_challenge"),
+		email:       r.PostForm.Get("email"),
+		verified:    r.PostForm.Get("email_verified") == "true",
+		expiresAt:   time.Now().Add(time.Minute),
+	}
+	s.mu.Unlock()
+
+	q := redirectURI.Query()
+	q.Set("code", code)
+	q.Set("state", r.PostForm.Get("state"))
+	redirectURI.RawQuery = q.Encode()
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+func (s *server) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		tokenError(w, "invalid_request")
+		return
+	}
+
+	clientID, clientSecret, ok := r.BasicAuth()
+	if ok {
+		clientID, _ = url.QueryUnescape(clientID)
+		clientSecret, _ = url.QueryUnescape(clientSecret)
+	} else {
+		clientID, clientSecret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if clientID != s.clientID || subtle.ConstantTimeCompare([]byte(clientSecret), []byte(s.clientSecret)) != 1 {
+		tokenError(w, "invalid_client")
+		return
+	}
+
+	s.mu.Lock()
+	c, found := s.codes[r.PostForm.Get("code")]
+	delete(s.codes, r.PostForm.Get("code"))
+	s.mu.Unlock()
+
+	if r.PostForm.Get("grant_type") != "authorization_code" || !found || time.Now().After(c.expiresAt) ||
+		c.redirectURI != r.PostForm.Get("redirect_uri") {
+		tokenError(w, "invalid_grant")
+		return
+	}
+
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(sum[:]) != c.challenge {
+		tokenError(w, "invalid_grant")
+		return
+	}
+
+	now := time.Now()
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":            s.issuer,
+		"sub":            "mock|" + c.email,
+		"aud":            s.clientID,
+		"iat":            now.Unix(),
+		"exp":            now.Add(5 * time.Minute).Unix(),
+		"nonce":          c.nonce,
+		"email":          c.email,
+		"email_verified": c.verified,
+		"name":           strings.Split(c.email, "@")[0],
+	})
+	idToken.Header["kid"] = keyID
+	signed, err := idToken.SignedString(s.key)
+	if err != nil {
+		tokenError(w, "server_error")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     signed,
+	})
+}
+
+func tokenError(w http.ResponseWriter, code string) {
+	writeJSON(w, http.StatusBadRequest, map[string]string{"error": code})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func randomString() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
@@ -0,0 +1,8 @@
+ALTER TABLE cards
+    ADD COLUMN front_hash CHAR(64) NULL AFTER back,
+    ADD COLUMN content_hash CHAR(64) NULL AFTER front_hash,
+    ADD INDEX deck_front_hash_idx (deck_id, front_hash),
+    ADD INDEX deck_content_hash_idx (deck_id, content_hash);
+
+-- Existing cards are hashed at startup by handlers.BackfillCardHashes, since
+-- SQL can't match the normalization in handlers.normalizeCardText exactly.
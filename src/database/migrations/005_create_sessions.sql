@@ -0,0 +1,21 @@
+CREATE TABLE IF NOT EXISTS sessions (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    family_id VARCHAR(64) NOT NULL,
+    device VARCHAR(255) NOT NULL DEFAULT '',
+    user_agent VARCHAR(512) NOT NULL DEFAULT '',
+    ip VARCHAR(45) NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_seen_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    revoked_at TIMESTAMP NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    UNIQUE KEY family_idx (family_id),
+    INDEX user_revoked_idx (user_id, revoked_at)
+);
+
+-- Logins made before sessions existed
+INSERT INTO sessions (user_id, family_id, created_at, last_seen_at, revoked_at)
+SELECT user_id, family_id, MIN(created_at), MAX(created_at),
+       IF(SUM(revoked_at IS NULL) = 0, MAX(revoked_at), NULL)
+FROM refresh_tokens
+GROUP BY user_id, family_id;
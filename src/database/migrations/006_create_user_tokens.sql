@@ -0,0 +1,18 @@
+ALTER TABLE users ADD COLUMN email_verified_at TIMESTAMP NULL AFTER active;
+
+-- Accounts created before verification existed are trusted
+UPDATE users SET email_verified_at = created_at;
+
+CREATE TABLE IF NOT EXISTS user_tokens (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    purpose VARCHAR(32) NOT NULL,
+    token_hash CHAR(64) NOT NULL,
+    data VARCHAR(255) NOT NULL DEFAULT '',
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    UNIQUE KEY token_hash_idx (token_hash),
+    INDEX user_purpose_idx (user_id, purpose)
+);
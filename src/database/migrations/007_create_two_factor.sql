@@ -0,0 +1,15 @@
+ALTER TABLE users
+    ADD COLUMN totp_secret VARCHAR(64) NULL AFTER email_verified_at,
+    ADD COLUMN totp_enabled TINYINT NOT NULL DEFAULT 0 AFTER totp_secret,
+    ADD COLUMN totp_last_step BIGINT NOT NULL DEFAULT 0 AFTER totp_enabled;
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    -- bcrypt, so codes are checked one by one rather than looked up
+    code_hash VARCHAR(60) NOT NULL,
+    used_at TIMESTAMP NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    INDEX user_idx (user_id)
+);
@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS invites (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    code_hash CHAR(64) NOT NULL,
+    note VARCHAR(255) NOT NULL DEFAULT '',
+    max_uses INT NOT NULL DEFAULT 1,
+    uses INT NOT NULL DEFAULT 0,
+    expires_at TIMESTAMP NULL,
+    created_by INT NULL,
+    revoked_at TIMESTAMP NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (created_by) REFERENCES users(id) ON DELETE SET NULL,
+    UNIQUE KEY code_hash_idx (code_hash)
+);
+
+ALTER TABLE users
+    ADD COLUMN invite_id INT NULL AFTER active,
+    ADD FOREIGN KEY (invite_id) REFERENCES invites(id) ON DELETE SET NULL;
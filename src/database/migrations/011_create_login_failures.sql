@@ -0,0 +1,21 @@
+-- Failed logins are counted per submitted email, whether or not an account
+-- exists for it, so lockouts don't reveal which emails are registered
+CREATE TABLE IF NOT EXISTS login_failures (
+    email_hash CHAR(64) PRIMARY KEY,
+    failures INT NOT NULL DEFAULT 0,
+    last_failed_at TIMESTAMP NULL,
+    locked_until TIMESTAMP NULL
+);
+
+CREATE TABLE IF NOT EXISTS audit_events (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NULL,
+    event VARCHAR(64) NOT NULL,
+    detail VARCHAR(255) NOT NULL DEFAULT '',
+    ip VARCHAR(45) NOT NULL DEFAULT '',
+    user_agent VARCHAR(512) NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE SET NULL,
+    INDEX user_created_idx (user_id, created_at),
+    INDEX event_created_idx (event, created_at)
+);
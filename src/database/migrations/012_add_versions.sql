@@ -0,0 +1,3 @@
+-- Bumped on every update so concurrent edits can be detected
+ALTER TABLE decks ADD COLUMN version INT NOT NULL DEFAULT 1;
+ALTER TABLE cards ADD COLUMN version INT NOT NULL DEFAULT 1;
@@ -0,0 +1,14 @@
+-- Responses to POSTs sent with an Idempotency-Key, replayed when a client retries
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    key_hash CHAR(64) NOT NULL,
+    request_hash CHAR(64) NOT NULL,
+    -- NULL while the first request is still being handled
+    status_code INT NULL,
+    response MEDIUMBLOB NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    UNIQUE KEY user_key_idx (user_id, key_hash),
+    INDEX created_idx (created_at)
+);
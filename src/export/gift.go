@@ -0,0 +1,46 @@
+package export
+
+import (
+	"fmt"
+	"strings"
+
+	"quizzler/models"
+)
+
+var giftEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	`~`, `\~`,
+	`=`, `\=`,
+	`#`, `\#`,
+	`{`, `\{`,
+	`}`, `\}`,
+	`:`, `\:`,
+	"\r\n", `\n`,
+	"\n", `\n`,
+)
+
+// GIFT renders a deck as Moodle GIFT questions in a category named after the deck
+func GIFT(deck models.Deck, cards []models.Card, opts QuizOptions) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "// Exported from Quizzler\n$CATEGORY: %s\n\n", giftEscaper.Replace(deck.Name))
+
+	for i, card := range cards {
+		fmt.Fprintf(&b, "::Q%d:: %s {", i+1, giftEscaper.Replace(strings.TrimSpace(card.Front)))
+
+		answer := giftEscaper.Replace(strings.TrimSpace(card.Back))
+		wrong := choicesFor(card, cards, opts)
+		if len(wrong) == 0 {
+			fmt.Fprintf(&b, "=%s}\n\n", answer)
+			continue
+		}
+
+		fmt.Fprintf(&b, "\n\t=%s\n", answer)
+		for _, d := range wrong {
+			fmt.Fprintf(&b, "\t~%s\n", giftEscaper.Replace(strings.TrimSpace(d)))
+		}
+		b.WriteString("}\n\n")
+	}
+
+	return b.String()
+}
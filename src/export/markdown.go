@@ -0,0 +1,54 @@
+package export
+
+import (
+	"fmt"
+	"strings"
+
+	"quizzler/models"
+)
+
+// Markdown styles
+const (
+	MarkdownTable = "table"
+	MarkdownList  = "list"
+)
+
+// Markdown renders a deck as a Markdown document using either a table or a list
+func Markdown(deck models.Deck, cards []models.Card, style string) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "# %s\n\n", oneLine(deck.Name))
+	if deck.Description != "" {
+		fmt.Fprintf(&b, "%s\n\n", deck.Description)
+	}
+
+	if style == MarkdownList {
+		for _, card := range cards {
+			fmt.Fprintf(&b, "- **%s**\n", escapeInline(oneLine(card.Front)))
+			for _, line := range strings.Split(strings.TrimSpace(card.Back), "\n") {
+				fmt.Fprintf(&b, "  %s\n", strings.TrimRight(line, "\r"))
+			}
+		}
+		return b.String()
+	}
+
+	b.WriteString("| Front | Back |\n| --- | --- |\n")
+	for _, card := range cards {
+		fmt.Fprintf(&b, "| %s | %s |\n", tableCell(card.Front), tableCell(card.Back))
+	}
+	return b.String()
+}
+
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+func escapeInline(s string) string {
+	return strings.ReplaceAll(s, "*", `\*`)
+}
+
+func tableCell(s string) string {
+	s = strings.ReplaceAll(strings.TrimSpace(s), "\r\n", "\n")
+	s = strings.ReplaceAll(s, "|", `\|`)
+	return strings.ReplaceAll(s, "\n", "<br>")
+}
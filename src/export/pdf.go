@@ -0,0 +1,254 @@
+package export
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"strings"
+
+	"quizzler/models"
+)
+
+// A4 in points, laid out as a grid of cards
+const (
+	pageWidth    = 595.0
+	pageHeight   = 842.0
+	pageMargin   = 36.0
+	gridCols     = 2
+	gridRows     = 4
+	cellPadding  = 14.0
+	maxFontSize  = 16.0
+	minFontSize  = 7.0
+	lineSpacing  = 1.25
+	cardsPerPage = gridCols * gridRows
+)
+
+// PDF renders a deck as printable flashcards. Each sheet is a page of fronts
+// followed by a page of backs with the columns mirrored, so that the backs line
+// up with their fronts when printed duplex (flip on long edge) and cut along
+// the guides.
+func PDF(deck models.Deck, cards []models.Card) []byte {
+	var pages []string
+	for start := 0; start < len(cards); start += cardsPerPage {
+		sheet := cards[start:min(start+cardsPerPage, len(cards))]
+		pages = append(pages, cardPage(sheet, false), cardPage(sheet, true))
+	}
+	if len(pages) == 0 {
+		pages = append(pages, cardPage(nil, false))
+	}
+
+	return buildPDF(deck.Name, pages)
+}
+
+// cardPage returns the content stream for one side of a sheet
+func cardPage(cards []models.Card, back bool) string {
+	cellWidth := (pageWidth - 2*pageMargin) / gridCols
+	cellHeight := (pageHeight - 2*pageMargin) / gridRows
+
+	var b strings.Builder
+	b.WriteString("0.6 G 0.5 w [4 4] 0 d\n")
+	for row := range gridRows {
+		for col := range gridCols {
+			x := pageMargin + float64(col)*cellWidth
+			y := pageHeight - pageMargin - float64(row+1)*cellHeight
+			fmt.Fprintf(&b, "%.2f %.2f %.2f %.2f re S\n", x, y, cellWidth, cellHeight)
+		}
+	}
+	b.WriteString("[] 0 d 0 g\n")
+
+	for i, card := range cards {
+		row, col := i/gridCols, i%gridCols
+		text := card.Front
+		if back {
+			col = gridCols - 1 - col
+			text = card.Back
+		}
+		x := pageMargin + float64(col)*cellWidth
+		y := pageHeight - pageMargin - float64(row+1)*cellHeight
+		writeCellText(&b, text, x, y, cellWidth, cellHeight)
+	}
+
+	return b.String()
+}
+
+// writeCellText draws text centred in a cell, shrinking the font until it fits
+func writeCellText(b *strings.Builder, text string, x, y, w, h float64) {
+	maxWidth := w - 2*cellPadding
+	maxHeight := h - 2*cellPadding
+
+	size := maxFontSize
+	lines := wrapText(text, size, maxWidth)
+	for size > minFontSize && float64(len(lines))*size*lineSpacing > maxHeight {
+		size--
+		lines = wrapText(text, size, maxWidth)
+	}
+
+	maxLines := int(maxHeight / (size * lineSpacing))
+	if len(lines) > maxLines {
+		lines = lines[:maxLines]
+		lines[maxLines-1] += "..."
+	}
+
+	blockHeight := float64(len(lines)) * size * lineSpacing
+	top := y + h/2 + blockHeight/2
+
+	for i, line := range lines {
+		lineWidth := textWidth(line, size)
+		lx := x + (w-lineWidth)/2
+		ly := top - size - float64(i)*size*lineSpacing
+		fmt.Fprintf(b, "BT /F1 %.1f Tf %.2f %.2f Td (%s) Tj ET\n", size, lx, ly, pdfString(line))
+	}
+}
+
+// wrapText breaks text into lines no wider than maxWidth at the given font size
+func wrapText(text string, size, maxWidth float64) []string {
+	var lines []string
+	for _, para := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+		words := strings.Fields(para)
+		if len(words) == 0 {
+			lines = append(lines, "")
+			continue
+		}
+
+		line := ""
+		for _, word := range words {
+			for textWidth(word, size) > maxWidth && len([]rune(word)) > 1 {
+				// Hard-break words longer than a whole line
+				runes := []rune(word)
+				n := len(runes) - 1
+				for n > 1 && textWidth(string(runes[:n]), size) > maxWidth {
+					n--
+				}
+				if line != "" {
+					lines = append(lines, line)
+					line = ""
+				}
+				lines = append(lines, string(runes[:n]))
+				word = string(runes[n:])
+			}
+
+			candidate := word
+			if line != "" {
+				candidate = line + " " + word
+			}
+			if line != "" && textWidth(candidate, size) > maxWidth {
+				lines = append(lines, line)
+				candidate = word
+			}
+			line = candidate
+		}
+		lines = append(lines, line)
+	}
+
+	// Drop leading and trailing blank lines
+	for len(lines) > 0 && lines[0] == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// helveticaWidths are the Helvetica advance widths for ASCII 32-126 in 1/1000 em
+var helveticaWidths = [...]int{
+	278, 278, 355, 556, 556, 889, 667, 191, 333, 333, 389, 584, 278, 333, 278, 278,
+	556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 278, 278, 584, 584, 584, 556,
+	1015, 667, 667, 722, 722, 667, 611, 778, 722, 278, 500, 667, 556, 833, 722, 778,
+	667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 278, 278, 278, 469, 556,
+	333, 556, 556, 500, 556, 556, 278, 556, 556, 222, 222, 500, 222, 833, 556, 556,
+	556, 556, 333, 500, 278, 556, 500, 722, 500, 500, 500, 334, 260, 334, 584,
+}
+
+func textWidth(s string, size float64) float64 {
+	total := 0
+	for _, r := range s {
+		if r >= 32 && r <= 126 {
+			total += helveticaWidths[r-32]
+		} else {
+			total += 556
+		}
+	}
+	return float64(total) * size / 1000
+}
+
+// winAnsiExtras maps the non-Latin-1 characters available in WinAnsiEncoding
+var winAnsiExtras = map[rune]byte{
+	'€': 0x80, '‚': 0x82, 'ƒ': 0x83, '„': 0x84, '…': 0x85, '†': 0x86, '‡': 0x87,
+	'ˆ': 0x88, '‰': 0x89, 'Š': 0x8A, '‹': 0x8B, 'Œ': 0x8C, 'Ž': 0x8E, '‘': 0x91,
+	'’': 0x92, '“': 0x93, '”': 0x94, '•': 0x95, '–': 0x96, '—': 0x97, '˜': 0x98,
+	'™': 0x99, 'š': 0x9A, '›': 0x9B, 'œ': 0x9C, 'ž': 0x9E, 'Ÿ': 0x9F,
+}
+
+// pdfString encodes text as an escaped WinAnsi literal string body
+func pdfString(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		var c byte
+		switch {
+		case r == '\\' || r == '(' || r == ')':
+			b.WriteByte('\\')
+			c = byte(r)
+		case r >= 32 && r <= 126, r >= 0xA0 && r <= 0xFF:
+			c = byte(r)
+		case r == '\t':
+			c = ' '
+		default:
+			var ok bool
+			if c, ok = winAnsiExtras[r]; !ok {
+				c = '?'
+			}
+		}
+		if c < 32 || c > 126 {
+			fmt.Fprintf(&b, "\\%03o", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// buildPDF assembles a PDF document from page content streams
+func buildPDF(title string, pages []string) []byte {
+	var buf bytes.Buffer
+	var offsets []int
+
+	addObject := func(body string) {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	buf.WriteString("%PDF-1.4\n%\xE2\xE3\xCF\xD3\n")
+
+	// Objects 1-4 are fixed, then each page is a page object followed by its content stream
+	const firstPageObj = 5
+	kids := make([]string, len(pages))
+	for i := range pages {
+		kids[i] = fmt.Sprintf("%d 0 R", firstPageObj+2*i)
+	}
+
+	addObject("<< /Type /Catalog /Pages 2 0 R >>")
+	addObject(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)))
+	addObject("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	addObject(fmt.Sprintf("<< /Title (%s) /Producer (Quizzler) >>", pdfString(title)))
+
+	for i, content := range pages {
+		addObject(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.0f %.0f] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>",
+			pageWidth, pageHeight, firstPageObj+2*i+1))
+
+		var compressed bytes.Buffer
+		zw := zlib.NewWriter(&compressed)
+		zw.Write([]byte(content))
+		zw.Close()
+		addObject(fmt.Sprintf("<< /Length %d /Filter /FlateDecode >>\nstream\n%s\nendstream", compressed.Len(), compressed.String()))
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R /Info 4 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+
+	return buf.Bytes()
+}
@@ -0,0 +1,201 @@
+package export
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"strings"
+
+	"quizzler/models"
+)
+
+const (
+	qtiNamespace      = "http://www.imsglobal.org/xsd/imsqti_v2p1"
+	qtiSchemaLocation = "http://www.imsglobal.org/xsd/imsqti_v2p1 http://www.imsglobal.org/xsd/qti/qtiv2p1/imsqti_v2p1.xsd"
+	qtiMatchCorrect   = "http://www.imsglobal.org/question/qti_v2p1/rptemplates/match_correct"
+	imscpNamespace    = "http://www.imsglobal.org/xsd/imscp_v1p1"
+)
+
+type qtiItem struct {
+	XMLName        xml.Name          `xml:"assessmentItem"`
+	Xmlns          string            `xml:"xmlns,attr"`
+	XmlnsXsi       string            `xml:"xmlns:xsi,attr"`
+	SchemaLocation string            `xml:"xsi:schemaLocation,attr"`
+	Identifier     string            `xml:"identifier,attr"`
+	Title          string            `xml:"title,attr"`
+	Adaptive       bool              `xml:"adaptive,attr"`
+	TimeDependent  bool              `xml:"timeDependent,attr"`
+	Response       qtiDeclaration    `xml:"responseDeclaration"`
+	Outcome        qtiDeclaration    `xml:"outcomeDeclaration"`
+	Body           qtiItemBody       `xml:"itemBody"`
+	Processing     qtiRespProcessing `xml:"responseProcessing"`
+}
+
+type qtiDeclaration struct {
+	Identifier   string     `xml:"identifier,attr"`
+	Cardinality  string     `xml:"cardinality,attr"`
+	BaseType     string     `xml:"baseType,attr"`
+	Correct      *qtiValues `xml:"correctResponse,omitempty"`
+	DefaultValue *qtiValues `xml:"defaultValue,omitempty"`
+}
+
+type qtiValues struct {
+	Value string `xml:"value"`
+}
+
+type qtiItemBody struct {
+	Paragraphs []qtiParagraph  `xml:"p"`
+	Choice     *qtiChoiceGroup `xml:"choiceInteraction,omitempty"`
+}
+
+type qtiParagraph struct {
+	Text      string        `xml:",chardata"`
+	TextEntry *qtiTextEntry `xml:"textEntryInteraction,omitempty"`
+}
+
+type qtiTextEntry struct {
+	ResponseIdentifier string `xml:"responseIdentifier,attr"`
+	ExpectedLength     int    `xml:"expectedLength,attr"`
+}
+
+type qtiChoiceGroup struct {
+	ResponseIdentifier string      `xml:"responseIdentifier,attr"`
+	Shuffle            bool        `xml:"shuffle,attr"`
+	MaxChoices         int         `xml:"maxChoices,attr"`
+	Prompt             string      `xml:"prompt"`
+	Choices            []qtiChoice `xml:"simpleChoice"`
+}
+
+type qtiChoice struct {
+	Identifier string `xml:"identifier,attr"`
+	Text       string `xml:",chardata"`
+}
+
+type qtiRespProcessing struct {
+	Template string `xml:"template,attr"`
+}
+
+type imsManifest struct {
+	XMLName    xml.Name      `xml:"manifest"`
+	Xmlns      string        `xml:"xmlns,attr"`
+	Identifier string        `xml:"identifier,attr"`
+	Metadata   imsMetadata   `xml:"metadata"`
+	Orgs       struct{}      `xml:"organizations"`
+	Resources  []imsResource `xml:"resources>resource"`
+}
+
+type imsMetadata struct {
+	Schema        string `xml:"schema"`
+	SchemaVersion string `xml:"schemaversion"`
+}
+
+type imsResource struct {
+	Identifier string `xml:"identifier,attr"`
+	Type       string `xml:"type,attr"`
+	Href       string `xml:"href,attr"`
+	File       struct {
+		Href string `xml:"href,attr"`
+	} `xml:"file"`
+}
+
+// QTI renders a deck as an IMS QTI 2.1 content package (ZIP) with one assessment item per card
+func QTI(deck models.Deck, cards []models.Card, opts QuizOptions) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+
+	manifest := imsManifest{
+		Xmlns:      imscpNamespace,
+		Identifier: fmt.Sprintf("quizzler-deck-%d", deck.ID),
+		Metadata:   imsMetadata{Schema: "QTIv2.1 Package", SchemaVersion: "1.0.0"},
+	}
+
+	for i, card := range cards {
+		item := qtiItemFor(card, cards, opts, fmt.Sprintf("%s %d", deck.Name, i+1))
+		href := fmt.Sprintf("items/%s.xml", item.Identifier)
+
+		if err := writeXML(zw, href, item); err != nil {
+			return nil, err
+		}
+
+		res := imsResource{Identifier: item.Identifier, Type: "imsqti_item_xmlv2p1", Href: href}
+		res.File.Href = href
+		manifest.Resources = append(manifest.Resources, res)
+	}
+
+	if err := writeXML(zw, "imsmanifest.xml", manifest); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func qtiItemFor(card models.Card, cards []models.Card, opts QuizOptions, title string) qtiItem {
+	item := qtiItem{
+		Xmlns:          qtiNamespace,
+		XmlnsXsi:       "http://www.w3.org/2001/XMLSchema-instance",
+		SchemaLocation: qtiSchemaLocation,
+		Identifier:     fmt.Sprintf("card-%d", card.ID),
+		Title:          title,
+		Outcome: qtiDeclaration{
+			Identifier:   "SCORE",
+			Cardinality:  "single",
+			BaseType:     "float",
+			DefaultValue: &qtiValues{Value: "0"},
+		},
+		Processing: qtiRespProcessing{Template: qtiMatchCorrect},
+	}
+
+	front := strings.TrimSpace(card.Front)
+	back := strings.TrimSpace(card.Back)
+
+	wrong := choicesFor(card, cards, opts)
+	if len(wrong) == 0 {
+		item.Response = qtiDeclaration{
+			Identifier:  "RESPONSE",
+			Cardinality: "single",
+			BaseType:    "string",
+			Correct:     &qtiValues{Value: back},
+		}
+		item.Body.Paragraphs = []qtiParagraph{
+			{Text: front},
+			{TextEntry: &qtiTextEntry{ResponseIdentifier: "RESPONSE", ExpectedLength: max(len(back), 10)}},
+		}
+		return item
+	}
+
+	choices := []qtiChoice{{Identifier: "CHOICE_0", Text: back}}
+	for i, d := range wrong {
+		choices = append(choices, qtiChoice{Identifier: fmt.Sprintf("CHOICE_%d", i+1), Text: strings.TrimSpace(d)})
+	}
+
+	item.Response = qtiDeclaration{
+		Identifier:  "RESPONSE",
+		Cardinality: "single",
+		BaseType:    "identifier",
+		Correct:     &qtiValues{Value: "CHOICE_0"},
+	}
+	item.Body.Choice = &qtiChoiceGroup{
+		ResponseIdentifier: "RESPONSE",
+		Shuffle:            true,
+		MaxChoices:         1,
+		Prompt:             front,
+		Choices:            choices,
+	}
+	return item
+}
+
+func writeXML(zw *zip.Writer, name string, v any) error {
+	f, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write([]byte(xml.Header)); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(f)
+	enc.Indent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,54 @@
+package export
+
+import (
+	"math/rand/v2"
+	"strings"
+
+	"quizzler/models"
+)
+
+// Quiz question types
+const (
+	QuestionShortAnswer    = "short"
+	QuestionMultipleChoice = "choice"
+)
+
+const (
+	DefaultChoices = 4
+	MaxChoices     = 6
+)
+
+// QuizOptions controls how cards are turned into quiz questions
+type QuizOptions struct {
+	Type    string
+	Choices int // total options per multiple-choice question, including the answer
+}
+
+// distractors picks up to n wrong answers for a card from the backs of the
+// other cards in the deck. Picks are seeded by card ID so repeated exports of
+// the same deck produce the same questions.
+func distractors(card models.Card, cards []models.Card, n int) []string {
+	seen := map[string]bool{strings.ToLower(strings.TrimSpace(card.Back)): true}
+	var pool []string
+	for _, other := range cards {
+		key := strings.ToLower(strings.TrimSpace(other.Back))
+		if other.ID == card.ID || key == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		pool = append(pool, other.Back)
+	}
+
+	rng := rand.New(rand.NewPCG(uint64(card.ID), uint64(card.DeckID)))
+	rng.Shuffle(len(pool), func(i, j int) { pool[i], pool[j] = pool[j], pool[i] })
+
+	return pool[:min(n, len(pool))]
+}
+
+// choicesFor returns the distractors to use for a card, or nil for a short-answer question
+func choicesFor(card models.Card, cards []models.Card, opts QuizOptions) []string {
+	if opts.Type != QuestionMultipleChoice {
+		return nil
+	}
+	return distractors(card, cards, opts.Choices-1)
+}
@@ -0,0 +1,172 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+
+	"quizzler/database"
+	"quizzler/mailer"
+	"quizzler/middleware"
+	"quizzler/models"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// getUser loads a user without their password hash
+func getUser(userID int) (models.User, error) {
+	var user models.User
+	err := database.DB.QueryRow("SELECT id, email, email_verified_at IS NOT NULL, totp_enabled, admin, active, created_at, updated_at FROM users WHERE id = ?", userID).
+		Scan(&user.ID, &user.Email, &user.EmailVerified, &user.TwoFactorEnabled, &user.Admin, &user.Active, &user.CreatedAt, &user.UpdatedAt)
+	return user, err
+}
+
+// GetMe returns the current user
+func GetMe(w http.ResponseWriter, r *http.Request) {
+	user, err := getUser(middleware.GetUserID(r))
+	if err != nil {
+		http.Error(w, `{"error": "User not found"}`, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
+
+// checkCurrentPassword verifies the user's password, writing an error response if it doesn't match
+func checkCurrentPassword(w http.ResponseWriter, userID int, password string) bool {
+	var hashedPassword string
+	if err := database.DB.QueryRow("SELECT password FROM users WHERE id = ?", userID).Scan(&hashedPassword); err != nil {
+		http.Error(w, `{"error": "User not found"}`, http.StatusNotFound)
+		return false
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password)); err != nil {
+		http.Error(w, `{"error": "Current password is incorrect"}`, http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// ChangePassword sets a new password and signs out every other session
+func ChangePassword(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.GetUserID(r)
+
+	var req models.ChangePasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	if req.CurrentPassword == "" || req.NewPassword == "" {
+		http.Error(w, `{"error": "Current and new password are required"}`, http.StatusBadRequest)
+		return
+	}
+
+	if !checkCurrentPassword(w, userID, req.CurrentPassword) {
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, `{"error": "Failed to hash password"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := database.DB.Exec("UPDATE users SET password = ? WHERE id = ?", string(hashedPassword), userID); err != nil {
+		http.Error(w, `{"error": "Failed to update password"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := revokeUserSessions(userID, middleware.GetFamilyID(r)); err != nil {
+		slog.Error("Failed to revoke sessions after password change", "user_id", userID, "error", err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ChangeEmail sends a confirmation link to the new address. The email is only
+// changed once the link is used, see ConfirmEmailChange.
+func ChangeEmail(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.GetUserID(r)
+
+	var req models.ChangeEmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	if req.Email == "" || req.CurrentPassword == "" {
+		http.Error(w, `{"error": "Email and current password are required"}`, http.StatusBadRequest)
+		return
+	}
+
+	if !checkCurrentPassword(w, userID, req.CurrentPassword) {
+		return
+	}
+
+	var count int
+	database.DB.QueryRow("SELECT COUNT(*) FROM users WHERE email = ?", req.Email).Scan(&count)
+	if count > 0 {
+		http.Error(w, `{"error": "Email already exists"}`, http.StatusConflict)
+		return
+	}
+
+	token, err := createUserToken(userID, tokenChangeEmail, req.Email, changeEmailTTL)
+	if err != nil {
+		http.Error(w, `{"error": "Failed to start email change"}`, http.StatusInternalServerError)
+		return
+	}
+
+	mailer.SendAsync(mailer.Message{
+		To:      req.Email,
+		Subject: "Confirm your new Quizzler email address",
+		Body: fmt.Sprintf("Open this link to start using this address for your Quizzler account:\n%s/confirm-email?token=%s\n\n"+
+			"If you didn't ask for this, you can ignore this email.\n",
+			mailer.AppURL(), url.QueryEscape(token)),
+	})
+
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(`{"message": "A confirmation link has been sent to the new address"}`))
+}
+
+// ConfirmEmailChange switches the account to the address a change token was sent to
+func ConfirmEmailChange(w http.ResponseWriter, r *http.Request) {
+	var req models.VerifyEmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	if req.Token == "" {
+		http.Error(w, `{"error": "Token is required"}`, http.StatusBadRequest)
+		return
+	}
+
+	userID, newEmail, err := consumeUserToken(req.Token, tokenChangeEmail)
+	if err != nil {
+		http.Error(w, `{"error": "Invalid or expired confirmation token"}`, http.StatusBadRequest)
+		return
+	}
+
+	var oldEmail string
+	database.DB.QueryRow("SELECT email FROM users WHERE id = ?", userID).Scan(&oldEmail)
+
+	_, err = database.DB.Exec("UPDATE users SET email = ?, email_verified_at = NOW() WHERE id = ?", newEmail, userID)
+	if err != nil {
+		http.Error(w, `{"error": "Email already exists"}`, http.StatusConflict)
+		return
+	}
+
+	if oldEmail != "" {
+		mailer.SendAsync(mailer.Message{
+			To:      oldEmail,
+			Subject: "Your Quizzler email address was changed",
+			Body:    fmt.Sprintf("The email address for your Quizzler account was changed to %s.\n\nIf this wasn't you, reset your password straight away.\n", newEmail),
+		})
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,215 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"quizzler/cache"
+	"quizzler/database"
+	"quizzler/middleware"
+	"quizzler/models"
+)
+
+const (
+	defaultAdminPageSize = 50
+	maxAdminPageSize     = 200
+)
+
+// AdminGetUsers lists users, optionally filtered by an email search with ?q=
+func AdminGetUsers(w http.ResponseWriter, r *http.Request) {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = defaultAdminPageSize
+	}
+	limit = min(limit, maxAdminPageSize)
+	offset, err := strconv.Atoi(r.URL.Query().Get("offset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+
+	where := "1 = 1"
+	args := []any{}
+	if q := strings.TrimSpace(r.URL.Query().Get("q")); q != "" {
+		where = "u.email LIKE ?"
+		args = append(args, "%"+escapeLike(q)+"%")
+	}
+
+	list := models.AdminUserList{Users: []models.AdminUser{}}
+	if err := database.DB.QueryRow("SELECT COUNT(*) FROM users u WHERE "+where, args...).Scan(&list.Total); err != nil {
+		http.Error(w, `{"error": "Failed to fetch users"}`, http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := database.DB.Query(`
+		SELECT u.id, u.email, u.email_verified_at IS NOT NULL, u.totp_enabled, u.admin, u.active, u.created_at, u.updated_at,
+			   (SELECT COUNT(*) FROM decks WHERE user_id = u.id) as deck_count
+		FROM users u
+		WHERE `+where+`
+		ORDER BY u.id
+		LIMIT ? OFFSET ?
+	`, append(args, limit, offset)...)
+	if err != nil {
+		http.Error(w, `{"error": "Failed to fetch users"}`, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var user models.AdminUser
+		if err := rows.Scan(&user.ID, &user.Email, &user.EmailVerified, &user.TwoFactorEnabled, &user.Admin, &user.Active,
+			&user.CreatedAt, &user.UpdatedAt, &user.DeckCount); err != nil {
+			continue
+		}
+		list.Users = append(list.Users, user)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// AdminGetUser returns a single user
+func AdminGetUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, `{"error": "Invalid user ID"}`, http.StatusBadRequest)
+		return
+	}
+
+	user, err := getUser(userID)
+	if err != nil {
+		http.Error(w, `{"error": "User not found"}`, http.StatusNotFound)
+		return
+	}
+
+	result := models.AdminUser{User: user}
+	database.DB.QueryRow("SELECT COUNT(*) FROM decks WHERE user_id = ?", userID).Scan(&result.DeckCount)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// AdminUpdateUser promotes or demotes an admin, or deactivates or reactivates
+// an account. Deactivating signs the user out everywhere and revokes their API tokens.
+func AdminUpdateUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, `{"error": "Invalid user ID"}`, http.StatusBadRequest)
+		return
+	}
+
+	var req models.UpdateUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	if req.Admin == nil && req.Active == nil {
+		http.Error(w, `{"error": "Nothing to update"}`, http.StatusBadRequest)
+		return
+	}
+
+	// Stops the last admin from locking everyone out of the admin API
+	if userID == middleware.GetUserID(r) {
+		http.Error(w, `{"error": "You can't change your own admin or active status"}`, http.StatusBadRequest)
+		return
+	}
+
+	user, err := getUser(userID)
+	if err != nil {
+		http.Error(w, `{"error": "User not found"}`, http.StatusNotFound)
+		return
+	}
+
+	if req.Admin != nil {
+		user.Admin = *req.Admin
+	}
+	if req.Active != nil {
+		user.Active = *req.Active
+	}
+
+	if _, err := database.DB.Exec("UPDATE users SET admin = ?, active = ? WHERE id = ?", user.Admin, user.Active, userID); err != nil {
+		http.Error(w, `{"error": "Failed to update user"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if !user.Active {
+		if err := revokeUserSessions(userID, ""); err != nil {
+			slog.Error("Failed to revoke sessions of deactivated user", "user_id", userID, "error", err)
+		}
+		database.DB.Exec("UPDATE api_tokens SET revoked_at = NOW() WHERE user_id = ? AND revoked_at IS NULL", userID)
+	}
+
+	slog.Info("Admin updated user", "admin_id", middleware.GetUserID(r), "user_id", userID, "admin", user.Admin, "active", user.Active)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
+
+// AdminUnlockUser lifts a login lockout on a user's email
+func AdminUnlockUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, `{"error": "Invalid user ID"}`, http.StatusBadRequest)
+		return
+	}
+
+	user, err := getUser(userID)
+	if err != nil {
+		http.Error(w, `{"error": "User not found"}`, http.StatusNotFound)
+		return
+	}
+
+	if clearLoginFailures(user.Email) {
+		recordAuditEvent(r, userID, auditLoginUnlocked, fmt.Sprintf("unlocked by admin %d", middleware.GetUserID(r)))
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AdminGetStats returns instance-wide counts. There's no review count since
+// study sessions aren't recorded anywhere yet.
+func AdminGetStats(w http.ResponseWriter, r *http.Request) {
+	var stats models.InstanceStats
+	err := database.DB.QueryRow(`
+		SELECT COUNT(*), COALESCE(SUM(active = 1), 0), COALESCE(SUM(admin = 1), 0)
+		FROM users
+	`).Scan(&stats.Users, &stats.ActiveUsers, &stats.Admins)
+	if err != nil {
+		http.Error(w, `{"error": "Failed to fetch stats"}`, http.StatusInternalServerError)
+		return
+	}
+
+	err = database.DB.QueryRow("SELECT COUNT(*), COALESCE(SUM(public = 1), 0) FROM decks").Scan(&stats.Decks, &stats.PublicDecks)
+	if err != nil {
+		http.Error(w, `{"error": "Failed to fetch stats"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := database.DB.QueryRow("SELECT COUNT(*) FROM cards").Scan(&stats.Cards); err != nil {
+		http.Error(w, `{"error": "Failed to fetch stats"}`, http.StatusInternalServerError)
+		return
+	}
+
+	cacheStats := cache.GetStats()
+	stats.Cache = models.CacheStats{
+		Backend:       cacheStats.Backend,
+		RedisHealthy:  cacheStats.RedisHealthy,
+		Hits:          cacheStats.Hits,
+		Misses:        cacheStats.Misses,
+		Fallbacks:     cacheStats.Fallbacks,
+		MemoryEntries: cacheStats.MemoryEntries,
+		MemoryBuckets: cacheStats.MemoryBuckets,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// escapeLike escapes the wildcards in a LIKE pattern
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"quizzler/database"
+	"quizzler/middleware"
+	"quizzler/models"
+)
+
+const maxAPITokenName = 100
+
+// GetAPITokens lists the user's personal access tokens
+func GetAPITokens(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.GetUserID(r)
+
+	rows, err := database.DB.Query(`
+		SELECT id, name, scopes, expires_at, last_used_at, created_at
+		FROM api_tokens
+		WHERE user_id = ? AND revoked_at IS NULL
+		ORDER BY created_at DESC
+	`, userID)
+	if err != nil {
+		http.Error(w, `{"error": "Failed to fetch tokens"}`, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	tokens := []models.APIToken{}
+	for rows.Next() {
+		var token models.APIToken
+		var scopes string
+		var expiresAt, lastUsedAt sql.NullTime
+		if err := rows.Scan(&token.ID, &token.Name, &scopes, &expiresAt, &lastUsedAt, &token.CreatedAt); err != nil {
+			continue
+		}
+		token.Scopes = strings.Split(scopes, ",")
+		if expiresAt.Valid {
+			token.ExpiresAt = &expiresAt.Time
+		}
+		if lastUsedAt.Valid {
+			token.LastUsedAt = &lastUsedAt.Time
+		}
+		tokens = append(tokens, token)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// CreateAPIToken issues a personal access token. The token itself is only
+// returned here; we just keep its hash.
+func CreateAPIToken(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.GetUserID(r)
+
+	var req models.CreateAPITokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > maxAPITokenName {
+		http.Error(w, `{"error": "Name is required and must be at most 100 characters"}`, http.StatusBadRequest)
+		return
+	}
+
+	if len(req.Scopes) == 0 {
+		http.Error(w, `{"error": "At least one scope is required"}`, http.StatusBadRequest)
+		return
+	}
+	scopes := []string{}
+	for _, scope := range req.Scopes {
+		if !slices.Contains(middleware.Scopes, scope) {
+			http.Error(w, `{"error": "Unknown scope, expected decks:read, cards:write or import"}`, http.StatusBadRequest)
+			return
+		}
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		http.Error(w, `{"error": "Expiry must be in the future"}`, http.StatusBadRequest)
+		return
+	}
+
+	secret, err := middleware.NewOpaqueToken()
+	if err != nil {
+		http.Error(w, `{"error": "Failed to generate token"}`, http.StatusInternalServerError)
+		return
+	}
+	token := middleware.APITokenPrefix + secret
+
+	result, err := database.DB.Exec("INSERT INTO api_tokens (user_id, name, token_hash, scopes, expires_at) VALUES (?, ?, ?, ?, ?)",
+		userID, req.Name, middleware.HashToken(token), strings.Join(scopes, ","), req.ExpiresAt)
+	if err != nil {
+		http.Error(w, `{"error": "Failed to create token"}`, http.StatusInternalServerError)
+		return
+	}
+
+	id, _ := result.LastInsertId()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(models.CreateAPITokenResponse{
+		APIToken: models.APIToken{
+			ID:        int(id),
+			Name:      req.Name,
+			Scopes:    scopes,
+			ExpiresAt: req.ExpiresAt,
+			CreatedAt: time.Now(),
+		},
+		Token: token,
+	})
+}
+
+// DeleteAPIToken revokes one of the user's personal access tokens
+func DeleteAPIToken(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.GetUserID(r)
+	tokenID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, `{"error": "Invalid token ID"}`, http.StatusBadRequest)
+		return
+	}
+
+	result, err := database.DB.Exec("UPDATE api_tokens SET revoked_at = NOW() WHERE id = ? AND user_id = ? AND revoked_at IS NULL", tokenID, userID)
+	if err != nil {
+		http.Error(w, `{"error": "Failed to revoke token"}`, http.StatusInternalServerError)
+		return
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		http.Error(w, `{"error": "Token not found"}`, http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
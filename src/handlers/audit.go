@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"quizzler/database"
+	"quizzler/middleware"
+	"quizzler/models"
+)
+
+// Audit event names
+const (
+	auditLoginLocked   = "login.locked"
+	auditLoginUnlocked = "login.unlocked"
+)
+
+// recordAuditEvent stores a security-relevant event. userID may be 0 when
+// the event isn't tied to a known account.
+func recordAuditEvent(r *http.Request, userID int, event, detail string) {
+	var user any
+	if userID != 0 {
+		user = userID
+	}
+
+	_, err := database.DB.Exec("INSERT INTO audit_events (user_id, event, detail, ip, user_agent) VALUES (?, ?, ?, ?, ?)",
+		user, event, truncate(detail, 255), middleware.ClientIP(r), truncate(r.UserAgent(), 512))
+	if err != nil {
+		slog.Error("Failed to record audit event", "event", event, "error", err)
+	}
+	slog.Warn("Audit event", "event", event, "user_id", userID, "detail", detail, "ip", middleware.ClientIP(r))
+}
+
+// AdminGetAuditEvents lists recent audit events, optionally filtered by ?user_id= and ?event=
+func AdminGetAuditEvents(w http.ResponseWriter, r *http.Request) {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = defaultAdminPageSize
+	}
+	limit = min(limit, maxAdminPageSize)
+
+	where := "1 = 1"
+	args := []any{}
+	if userID, err := strconv.Atoi(r.URL.Query().Get("user_id")); err == nil {
+		where += " AND user_id = ?"
+		args = append(args, userID)
+	}
+	if event := r.URL.Query().Get("event"); event != "" {
+		where += " AND event = ?"
+		args = append(args, event)
+	}
+
+	rows, err := database.DB.Query(`
+		SELECT id, user_id, event, detail, ip, user_agent, created_at
+		FROM audit_events
+		WHERE `+where+`
+		ORDER BY id DESC
+		LIMIT ?
+	`, append(args, limit)...)
+	if err != nil {
+		http.Error(w, `{"error": "Failed to fetch audit events"}`, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	events := []models.AuditEvent{}
+	for rows.Next() {
+		var event models.AuditEvent
+		if err := rows.Scan(&event.ID, &event.UserID, &event.Event, &event.Detail, &event.IP, &event.UserAgent, &event.CreatedAt); err != nil {
+			continue
+		}
+		events = append(events, event)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
@@ -3,6 +3,7 @@ package handlers
 import (
 	"encoding/json"
 	"net/http"
+	"time"
 
 	"quizzler/database"
 	"quizzler/middleware"
@@ -23,6 +24,12 @@ func Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	needInvite, err := checkRegistration(req.Email, req.InviteCode)
+	if err != nil {
+		writeRegistrationError(w, err)
+		return
+	}
+
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
 	if err != nil {
 		http.Error(w, `{"error": "Failed to hash password"}`, http.StatusInternalServerError)
@@ -34,30 +41,66 @@ func Register(w http.ResponseWriter, r *http.Request) {
 	database.DB.QueryRow("SELECT COUNT(*) FROM users").Scan(&userCount)
 	isAdmin := userCount == 0
 
-	result, err := database.DB.Exec("INSERT INTO users (email, password, admin) VALUES (?, ?, ?)", req.Email, string(hashedPassword), isAdmin)
+	// The first user is verified up front so a new instance without mail configured can't lock itself out
+	var verifiedAt *time.Time
+	if isAdmin {
+		now := time.Now()
+		verifiedAt = &now
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, `{"error": "Failed to register"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// The invite is used up in the same transaction so a failed signup doesn't waste it
+	var inviteID *int
+	if needInvite {
+		id, err := redeemInvite(tx, req.InviteCode)
+		if err != nil {
+			writeRegistrationError(w, err)
+			return
+		}
+		inviteID = &id
+	}
+
+	result, err := tx.Exec("INSERT INTO users (email, password, admin, email_verified_at, invite_id) VALUES (?, ?, ?, ?, ?)",
+		req.Email, string(hashedPassword), isAdmin, verifiedAt, inviteID)
 	if err != nil {
 		http.Error(w, `{"error": "Email already exists"}`, http.StatusConflict)
 		return
 	}
 
 	userID, _ := result.LastInsertId()
-
-	token, err := middleware.GenerateToken(int(userID))
-	if err != nil {
-		http.Error(w, `{"error": "Failed to generate token"}`, http.StatusInternalServerError)
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error": "Failed to register"}`, http.StatusInternalServerError)
 		return
 	}
 
 	user := models.User{
-		ID:    int(userID),
-		Email: req.Email,
+		ID:            int(userID),
+		Email:         req.Email,
+		EmailVerified: verifiedAt != nil,
+		Admin:         isAdmin,
+		Active:        true,
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(models.AuthResponse{
-		Token: token,
-		User:  user,
-	})
+	if !user.EmailVerified {
+		sendVerificationEmail(user.ID, user.Email)
+
+		if requireEmailVerification() {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(models.AuthResponse{
+				User:                 user,
+				VerificationRequired: true,
+			})
+			return
+		}
+	}
+
+	respondWithSession(w, r, user, req.Device)
 }
 
 func Login(w http.ResponseWriter, r *http.Request) {
@@ -72,20 +115,76 @@ func Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Locks are tracked per email whether or not it has an account, so this doesn't leak which do
+	if remaining := loginLockedFor(req.Email); remaining > 0 {
+		writeLockedOut(w, remaining)
+		return
+	}
+
 	var user models.User
-	err := database.DB.QueryRow("SELECT id, email, password FROM users WHERE email = ?", req.Email).
-		Scan(&user.ID, &user.Email, &user.Password)
+	err := database.DB.QueryRow("SELECT id, email, password, email_verified_at IS NOT NULL, totp_enabled, admin, active FROM users WHERE email = ?", req.Email).
+		Scan(&user.ID, &user.Email, &user.Password, &user.EmailVerified, &user.TwoFactorEnabled, &user.Admin, &user.Active)
 	if err != nil {
+		burnPasswordCheck(req.Password)
+		recordLoginFailure(r, req.Email, 0)
 		http.Error(w, `{"error": "Invalid credentials"}`, http.StatusUnauthorized)
 		return
 	}
 
 	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)); err != nil {
+		recordLoginFailure(r, req.Email, user.ID)
 		http.Error(w, `{"error": "Invalid credentials"}`, http.StatusUnauthorized)
 		return
 	}
 
-	token, err := middleware.GenerateToken(user.ID)
+	// Two-factor logins only count as successful once the second step passes
+	if !user.TwoFactorEnabled {
+		clearLoginFailures(req.Email)
+	}
+
+	if !user.EmailVerified && requireEmailVerification() {
+		http.Error(w, `{"error": "Email address not verified"}`, http.StatusForbidden)
+		return
+	}
+
+	respondWithLogin(w, r, user, req.Device)
+}
+
+// respondWithLogin completes a login, asking for a second factor first if the user has one
+func respondWithLogin(w http.ResponseWriter, r *http.Request, user models.User, device string) {
+	if !user.Active {
+		http.Error(w, `{"error": "This account has been deactivated"}`, http.StatusForbidden)
+		return
+	}
+
+	if user.TwoFactorEnabled {
+		challenge, err := middleware.GenerateChallengeToken(user.ID, device)
+		if err != nil {
+			http.Error(w, `{"error": "Failed to generate token"}`, http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(models.TwoFactorChallengeResponse{
+			TwoFactorRequired: true,
+			ChallengeToken:    challenge,
+			ExpiresIn:         int(middleware.ChallengeTokenTTL.Seconds()),
+		})
+		return
+	}
+
+	respondWithSession(w, r, user, device)
+}
+
+// respondWithSession starts a new login session for the user and writes its tokens
+func respondWithSession(w http.ResponseWriter, r *http.Request, user models.User, device string) {
+	familyID, err := startSession(r, user.ID, device)
+	if err != nil {
+		http.Error(w, `{"error": "Failed to start session"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tokens, err := issueTokens(user.ID, familyID)
 	if err != nil {
 		http.Error(w, `{"error": "Failed to generate token"}`, http.StatusInternalServerError)
 		return
@@ -93,7 +192,9 @@ func Login(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(models.AuthResponse{
-		Token: token,
-		User:  user,
+		Token:        tokens.Token,
+		RefreshToken: tokens.RefreshToken,
+		ExpiresIn:    tokens.ExpiresIn,
+		User:         user,
 	})
 }
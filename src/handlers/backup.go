@@ -0,0 +1,263 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"quizzler/database"
+	"quizzler/middleware"
+	"quizzler/models"
+)
+
+const (
+	backupFileName = "backup.json"
+	maxBackupSize  = 64 << 20
+	// Limit on backup.json once decompressed, so a small zip bomb can't exhaust memory
+	maxBackupJSONSize = 256 << 20
+)
+
+// ExportAccount streams a ZIP archive containing all of the user's decks, cards and tags
+func ExportAccount(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.GetUserID(r)
+
+	backup := models.Backup{
+		Version:    models.BackupVersion,
+		ExportedAt: time.Now().UTC(),
+		Decks:      []models.BackupDeck{},
+	}
+	if err := database.DB.QueryRow("SELECT email FROM users WHERE id = ?", userID).Scan(&backup.Email); err != nil {
+		http.Error(w, `{"error": "User not found"}`, http.StatusNotFound)
+		return
+	}
+
+	rows, err := database.DB.Query("SELECT id, name, description, public, created_at, updated_at FROM decks WHERE user_id = ? ORDER BY id", userID)
+	if err != nil {
+		http.Error(w, `{"error": "Failed to fetch decks"}`, http.StatusInternalServerError)
+		return
+	}
+	deckIndex := map[int]int{}
+	for rows.Next() {
+		var deck models.BackupDeck
+		if err := rows.Scan(&deck.ID, &deck.Name, &deck.Description, &deck.Public, &deck.CreatedAt, &deck.UpdatedAt); err != nil {
+			continue
+		}
+		deck.Cards = []models.BackupCard{}
+		deckIndex[deck.ID] = len(backup.Decks)
+		backup.Decks = append(backup.Decks, deck)
+	}
+	rows.Close()
+
+	cardTags := map[int][]string{}
+	rows, err = database.DB.Query(`
+		SELECT ct.card_id, t.name
+		FROM card_tags ct
+		JOIN tags t ON ct.tag_id = t.id
+		WHERE t.user_id = ?
+		ORDER BY t.name
+	`, userID)
+	if err != nil {
+		http.Error(w, `{"error": "Failed to fetch tags"}`, http.StatusInternalServerError)
+		return
+	}
+	for rows.Next() {
+		var cardID int
+		var name string
+		if err := rows.Scan(&cardID, &name); err != nil {
+			continue
+		}
+		cardTags[cardID] = append(cardTags[cardID], name)
+	}
+	rows.Close()
+
+	rows, err = database.DB.Query(`
+		SELECT c.id, c.deck_id, c.front, c.back, c.created_at, c.updated_at
+		FROM cards c
+		JOIN decks d ON c.deck_id = d.id
+		WHERE d.user_id = ?
+		ORDER BY c.id
+	`, userID)
+	if err != nil {
+		http.Error(w, `{"error": "Failed to fetch cards"}`, http.StatusInternalServerError)
+		return
+	}
+	for rows.Next() {
+		var card models.BackupCard
+		var deckID int
+		if err := rows.Scan(&card.ID, &deckID, &card.Front, &card.Back, &card.CreatedAt, &card.UpdatedAt); err != nil {
+			continue
+		}
+		card.Tags = cardTags[card.ID]
+		if i, ok := deckIndex[deckID]; ok {
+			backup.Decks[i].Cards = append(backup.Decks[i].Cards, card)
+		}
+	}
+	rows.Close()
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="quizzler-backup-%s.zip"`, backup.ExportedAt.Format("20060102")))
+
+	zw := zip.NewWriter(w)
+	f, err := zw.Create(backupFileName)
+	if err == nil {
+		err = json.NewEncoder(f).Encode(backup)
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		slog.Error("Failed to write backup", "user_id", userID, "error", err)
+	}
+}
+
+// ImportAccount restores a backup archive into an account that has no decks yet
+func ImportAccount(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.GetUserID(r)
+
+	var deckCount int
+	database.DB.QueryRow("SELECT COUNT(*) FROM decks WHERE user_id = ?", userID).Scan(&deckCount)
+	if deckCount > 0 {
+		http.Error(w, `{"error": "Backups can only be restored into an account without decks"}`, http.StatusConflict)
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBackupSize))
+	if err != nil {
+		http.Error(w, `{"error": "Backup is too large"}`, http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	backup, err := readBackup(data)
+	if err != nil {
+		http.Error(w, `{"error": "Invalid backup archive"}`, http.StatusBadRequest)
+		return
+	}
+	if backup.Version > models.BackupVersion {
+		http.Error(w, `{"error": "Unsupported backup version"}`, http.StatusBadRequest)
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, `{"error": "Failed to restore backup"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Lock the user so concurrent restores queue up here, then check again
+	// now that no other restore can add decks under us
+	var lockedID int
+	if err := tx.QueryRow("SELECT id FROM users WHERE id = ? FOR UPDATE", userID).Scan(&lockedID); err != nil {
+		http.Error(w, `{"error": "Failed to restore backup"}`, http.StatusInternalServerError)
+		return
+	}
+	if err := tx.QueryRow("SELECT COUNT(*) FROM decks WHERE user_id = ?", userID).Scan(&deckCount); err != nil {
+		http.Error(w, `{"error": "Failed to restore backup"}`, http.StatusInternalServerError)
+		return
+	}
+	if deckCount > 0 {
+		http.Error(w, `{"error": "Backups can only be restored into an account without decks"}`, http.StatusConflict)
+		return
+	}
+
+	resp := models.RestoreResponse{DeckIDs: map[int]int{}}
+	tagIDs := map[string]int{}
+	for _, deck := range backup.Decks {
+		if deck.Name == "" {
+			continue
+		}
+		result, err := tx.Exec("INSERT INTO decks (user_id, name, description, public, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)",
+			userID, deck.Name, deck.Description, deck.Public, orNow(deck.CreatedAt), orNow(deck.UpdatedAt))
+		if err != nil {
+			http.Error(w, `{"error": "Failed to restore backup"}`, http.StatusInternalServerError)
+			return
+		}
+		newDeckID, _ := result.LastInsertId()
+		resp.DeckIDs[deck.ID] = int(newDeckID)
+		resp.Decks++
+
+		for _, card := range deck.Cards {
+			if card.Front == "" || card.Back == "" {
+				continue
+			}
+			frontHash, contentHash := cardHashes(card.Front, card.Back)
+			result, err := tx.Exec("INSERT INTO cards (deck_id, front, back, front_hash, content_hash, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+				newDeckID, card.Front, card.Back, frontHash, contentHash, orNow(card.CreatedAt), orNow(card.UpdatedAt))
+			if err != nil {
+				http.Error(w, `{"error": "Failed to restore backup"}`, http.StatusInternalServerError)
+				return
+			}
+			newCardID, _ := result.LastInsertId()
+			resp.Cards++
+
+			for _, name := range card.Tags {
+				tagID, ok := tagIDs[name]
+				if !ok {
+					if tagID, err = ensureTag(tx, userID, name); err != nil {
+						http.Error(w, `{"error": "Failed to restore backup"}`, http.StatusInternalServerError)
+						return
+					}
+					tagIDs[name] = tagID
+				}
+				if err := tagCard(tx, int(newCardID), tagID); err != nil {
+					http.Error(w, `{"error": "Failed to restore backup"}`, http.StatusInternalServerError)
+					return
+				}
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error": "Failed to restore backup"}`, http.StatusInternalServerError)
+		return
+	}
+	invalidateDeckLists(userID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// orNow returns t, or the current time if a backup left it out. MySQL
+// rejects the zero time.
+func orNow(t time.Time) time.Time {
+	if t.IsZero() {
+		return time.Now().UTC()
+	}
+	return t
+}
+
+// readBackup extracts backup.json from a ZIP archive
+func readBackup(data []byte) (*models.Backup, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range zr.File {
+		if f.Name != backupFileName {
+			continue
+		}
+		if f.UncompressedSize64 > maxBackupJSONSize {
+			return nil, fmt.Errorf("%s is too large", backupFileName)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+
+		// The header's size can lie, so the read is capped too
+		var backup models.Backup
+		if err := json.NewDecoder(io.LimitReader(rc, maxBackupJSONSize)).Decode(&backup); err != nil {
+			return nil, err
+		}
+		return &backup, nil
+	}
+
+	return nil, fmt.Errorf("%s not found in archive", backupFileName)
+}
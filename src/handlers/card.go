@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"net/http"
 	"strconv"
+	"time"
 
 	"quizzler/database"
 	"quizzler/middleware"
@@ -18,33 +19,39 @@ func GetCards(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	page, err := parseListPage(r, cardSorts, "created")
+	if err != nil {
+		http.Error(w, `{"error": "Invalid limit, cursor, sort or order"}`, http.StatusBadRequest)
+		return
+	}
+
 	// Verify deck belongs to user or is public
 	var deckUserID int
 	var isPublic bool
-	err = database.DB.QueryRow("SELECT user_id, public FROM decks WHERE id = ?", deckID).Scan(&deckUserID, &isPublic)
+	var updatedAt time.Time
+	err = database.DB.QueryRow("SELECT user_id, public, updated_at FROM decks WHERE id = ?", deckID).Scan(&deckUserID, &isPublic, &updatedAt)
 	if err != nil || (deckUserID != userID && !isPublic) {
 		http.Error(w, `{"error": "Deck not found"}`, http.StatusNotFound)
 		return
 	}
 
-	rows, err := database.DB.Query("SELECT id, deck_id, front, back, created_at, updated_at FROM cards WHERE deck_id = ? ORDER BY created_at", deckID)
+	// Without list parameters the whole deck is returned, as it always was
+	var cards []models.Card
+	var next string
+	if page.paginated {
+		cards, next, err = queryCardPage(page, deckID)
+	} else {
+		cards, err = deckCards(deckID, isPublic)
+	}
 	if err != nil {
 		http.Error(w, `{"error": "Failed to fetch cards"}`, http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
-
-	cards := []models.Card{}
-	for rows.Next() {
-		var card models.Card
-		if err := rows.Scan(&card.ID, &card.DeckID, &card.Front, &card.Back, &card.CreatedAt, &card.UpdatedAt); err != nil {
-			continue
-		}
-		cards = append(cards, card)
+	if next != "" {
+		setNextPage(w, r, next)
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(cards)
+	writeConditional(w, r, cards, updatedAt, cachePrivate)
 }
 
 func GetCard(w http.ResponseWriter, r *http.Request) {
@@ -55,21 +62,13 @@ func GetCard(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var card models.Card
-	var deckUserID int
-	err = database.DB.QueryRow(`
-		SELECT c.id, c.deck_id, c.front, c.back, c.created_at, c.updated_at, d.user_id
-		FROM cards c
-		JOIN decks d ON c.deck_id = d.id
-		WHERE c.id = ?
-	`, cardID).Scan(&card.ID, &card.DeckID, &card.Front, &card.Back, &card.CreatedAt, &card.UpdatedAt, &deckUserID)
-	if err != nil || deckUserID != userID {
+	card, ok := ownedCard(userID, cardID)
+	if !ok {
 		http.Error(w, `{"error": "Card not found"}`, http.StatusNotFound)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(card)
+	writeConditional(w, r, card, card.UpdatedAt, cachePrivate)
 }
 
 func CreateCard(w http.ResponseWriter, r *http.Request) {
@@ -99,20 +98,29 @@ func CreateCard(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	result, err := database.DB.Exec("INSERT INTO cards (deck_id, front, back) VALUES (?, ?, ?)", deckID, req.Front, req.Back)
+	policy, ok := parseDuplicatePolicy(req.Duplicates)
+	if !ok {
+		http.Error(w, `{"error": "Invalid duplicates policy"}`, http.StatusBadRequest)
+		return
+	}
+
+	cardID, outcome, err := writeCard(deckID, req.Front, req.Back, policy)
 	if err != nil {
 		http.Error(w, `{"error": "Failed to create card"}`, http.StatusInternalServerError)
 		return
 	}
-
-	cardID, _ := result.LastInsertId()
+	if outcome != cardSkipped {
+		cardsChanged(userID, deckID)
+	}
 
 	var card models.Card
-	database.DB.QueryRow("SELECT id, deck_id, front, back, created_at, updated_at FROM cards WHERE id = ?", cardID).
-		Scan(&card.ID, &card.DeckID, &card.Front, &card.Back, &card.CreatedAt, &card.UpdatedAt)
+	database.DB.QueryRow("SELECT id, deck_id, front, back, version, created_at, updated_at FROM cards WHERE id = ?", cardID).
+		Scan(&card.ID, &card.DeckID, &card.Front, &card.Back, &card.Version, &card.CreatedAt, &card.UpdatedAt)
 
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
+	if outcome == cardCreated {
+		w.WriteHeader(http.StatusCreated)
+	}
 	json.NewEncoder(w).Encode(card)
 }
 
@@ -124,14 +132,8 @@ func UpdateCard(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Verify card belongs to user's deck
-	var deckUserID int
-	err = database.DB.QueryRow(`
-		SELECT d.user_id FROM cards c
-		JOIN decks d ON c.deck_id = d.id
-		WHERE c.id = ?
-	`, cardID).Scan(&deckUserID)
-	if err != nil || deckUserID != userID {
+	current, ok := ownedCard(userID, cardID)
+	if !ok {
 		http.Error(w, `{"error": "Card not found"}`, http.StatusNotFound)
 		return
 	}
@@ -147,15 +149,33 @@ func UpdateCard(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = database.DB.Exec("UPDATE cards SET front = ?, back = ? WHERE id = ?", req.Front, req.Back, cardID)
+	version, ok := expectedVersion(r, req.Version, current, current.Version)
+	if !ok {
+		http.Error(w, `{"error": "Send If-Match or the version of the card being edited"}`, http.StatusPreconditionRequired)
+		return
+	}
+
+	frontHash, contentHash := cardHashes(req.Front, req.Back)
+	result, err := database.DB.Exec("UPDATE cards SET front = ?, back = ?, front_hash = ?, content_hash = ?, version = version + 1 WHERE id = ? AND version = ?",
+		req.Front, req.Back, frontHash, contentHash, cardID, version)
 	if err != nil {
 		http.Error(w, `{"error": "Failed to update card"}`, http.StatusInternalServerError)
 		return
 	}
 
-	var card models.Card
-	database.DB.QueryRow("SELECT id, deck_id, front, back, created_at, updated_at FROM cards WHERE id = ?", cardID).
-		Scan(&card.ID, &card.DeckID, &card.Front, &card.Back, &card.CreatedAt, &card.UpdatedAt)
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		// Someone else saved first, or it was deleted since we looked
+		if current, ok = ownedCard(userID, cardID); !ok {
+			http.Error(w, `{"error": "Card not found"}`, http.StatusNotFound)
+			return
+		}
+		writeConflict(w, "This card was changed by someone else", current)
+		return
+	}
+	cardsChanged(userID, current.DeckID)
+
+	card, _ := ownedCard(userID, cardID)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(card)
@@ -170,12 +190,12 @@ func DeleteCard(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Verify card belongs to user's deck
-	var deckUserID int
+	var deckID, deckUserID int
 	err = database.DB.QueryRow(`
-		SELECT d.user_id FROM cards c
+		SELECT c.deck_id, d.user_id FROM cards c
 		JOIN decks d ON c.deck_id = d.id
 		WHERE c.id = ?
-	`, cardID).Scan(&deckUserID)
+	`, cardID).Scan(&deckID, &deckUserID)
 	if err != nil || deckUserID != userID {
 		http.Error(w, `{"error": "Card not found"}`, http.StatusNotFound)
 		return
@@ -186,6 +206,7 @@ func DeleteCard(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, `{"error": "Failed to delete card"}`, http.StatusInternalServerError)
 		return
 	}
+	cardsChanged(userID, deckID)
 
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -217,16 +238,32 @@ func ImportCards(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	imported := 0
+	policy, ok := parseDuplicatePolicy(req.Duplicates)
+	if !ok {
+		http.Error(w, `{"error": "Invalid duplicates policy"}`, http.StatusBadRequest)
+		return
+	}
+
+	var resp models.ImportCardsResponse
 	for _, card := range req.Cards {
 		if card.Front == "" || card.Back == "" {
 			continue
 		}
-		_, err := database.DB.Exec("INSERT INTO cards (deck_id, front, back) VALUES (?, ?, ?)", deckID, card.Front, card.Back)
-		if err == nil {
-			imported++
+		_, outcome, err := writeCard(deckID, card.Front, card.Back, policy)
+		if err != nil {
+			continue
+		}
+		switch outcome {
+		case cardCreated:
+			resp.Imported++
+		case cardUpdated:
+			resp.Updated++
+		case cardSkipped:
+			resp.Skipped++
 		}
 	}
 
-	json.NewEncoder(w).Encode(models.ImportCardsResponse{Imported: imported})
+	cardsChanged(userID, deckID)
+
+	json.NewEncoder(w).Encode(resp)
 }
@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"quizzler/models"
+)
+
+const (
+	// Public decks can be cached by browsers and proxies for a minute, so a
+	// deck that's made private may stay visible to them for that long
+	cachePublic = "public, max-age=60"
+	// Everything else has to be revalidated, which the ETag makes cheap
+	cachePrivate = "private, no-cache"
+)
+
+// writeConditional writes value as JSON with a strong ETag of the body and
+// Last-Modified, answering If-None-Match and If-Modified-Since with a 304.
+// Range requests aren't supported, the whole body is always sent.
+func writeConditional(w http.ResponseWriter, r *http.Request, value any, lastModified time.Time, cacheControl string) {
+	body, etag, err := encodeWithETag(value)
+	if err != nil {
+		http.Error(w, `{"error": "Failed to encode response"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", cacheControl)
+	if !lastModified.IsZero() {
+		w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+
+	if notModified(r, etag, lastModified) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	if r.Method == http.MethodHead {
+		return
+	}
+	w.Write(body)
+}
+
+// notModified reports whether the client's copy is current. The ETag is the
+// authority: If-Modified-Since is only looked at without If-None-Match, and is
+// compared at the one second precision of HTTP dates.
+func notModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	if header := r.Header.Get("If-None-Match"); header != "" {
+		// If-None-Match uses the weak comparison
+		for _, candidate := range strings.Split(header, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	if lastModified.IsZero() {
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	return !lastModified.Truncate(time.Second).After(since)
+}
+
+// encodeWithETag encodes value as a response body along with its ETag
+func encodeWithETag(value any) ([]byte, string, error) {
+	body, err := json.Marshal(value)
+	if err != nil {
+		return nil, "", err
+	}
+	body = append(body, '\n')
+
+	sum := sha256.Sum256(body)
+	return body, `"` + hex.EncodeToString(sum[:16]) + `"`, nil
+}
+
+// ifMatch reports whether an If-Match header matches the current copy of a
+// resource, using the strong comparison RFC 9110 requires
+func ifMatch(header string, current any) bool {
+	_, etag, err := encodeWithETag(current)
+	if err != nil {
+		return false
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// expectedVersion works out which version an update was based on, from
+// If-Match or the version in the request body. ok is false if neither was sent.
+func expectedVersion(r *http.Request, bodyVersion *int, current any, currentVersion int) (version int, ok bool) {
+	if header := r.Header.Get("If-Match"); header != "" {
+		if !ifMatch(header, current) {
+			// Can't match, so the update is treated as a conflict
+			return -1, true
+		}
+		return currentVersion, true
+	}
+	if bodyVersion != nil {
+		return *bodyVersion, true
+	}
+	return 0, false
+}
+
+// writeConflict responds to an update based on an old version with the current copy
+func writeConflict(w http.ResponseWriter, message string, current any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(models.ConflictResponse{Error: message, Current: current})
+}
@@ -2,9 +2,9 @@ package handlers
 
 import (
 	"encoding/json"
-	"log/slog"
 	"net/http"
 	"strconv"
+	"time"
 
 	"quizzler/database"
 	"quizzler/middleware"
@@ -14,27 +14,26 @@ import (
 func GetDecks(w http.ResponseWriter, r *http.Request) {
 	userID := middleware.GetUserID(r)
 
-	rows, err := database.DB.Query(`
-		SELECT d.id, d.user_id, d.name, d.description, d.public, d.created_at, d.updated_at,
-			   (SELECT COUNT(*) FROM cards WHERE deck_id = d.id) as card_count
-		FROM decks d
-		WHERE d.user_id = ?
-		ORDER BY d.updated_at DESC
-	`, userID)
+	page, err := parseListPage(r, deckSorts, "updated")
 	if err != nil {
-		http.Error(w, `{"error": "Failed to fetch decks"}`, http.StatusInternalServerError)
+		http.Error(w, `{"error": "Invalid limit, cursor, sort or order"}`, http.StatusBadRequest)
 		return
 	}
-	defer rows.Close()
 
-	decks := []models.Deck{}
-	for rows.Next() {
-		var deck models.Deck
-		if err := rows.Scan(&deck.ID, &deck.UserID, &deck.Name, &deck.Description, &deck.Public, &deck.CreatedAt, &deck.UpdatedAt, &deck.CardCount); err != nil {
-			slog.Warn("Failed to scan deck", "error", err)
-			continue
-		}
-		decks = append(decks, deck)
+	// Without list parameters the whole list is returned, as it always was
+	var decks []models.Deck
+	var next string
+	if page.paginated {
+		decks, next, err = queryDeckPage(page, "d.user_id = ?", userID)
+	} else {
+		decks, err = cachedUserDecks(userID)
+	}
+	if err != nil {
+		http.Error(w, `{"error": "Failed to fetch decks"}`, http.StatusInternalServerError)
+		return
+	}
+	if next != "" {
+		setNextPage(w, r, next)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -51,18 +50,17 @@ func GetDeck(w http.ResponseWriter, r *http.Request) {
 
 	var deck models.Deck
 	err = database.DB.QueryRow(`
-		SELECT d.id, d.user_id, d.name, d.description, d.public, d.created_at, d.updated_at,
+		SELECT d.id, d.user_id, d.name, d.description, d.public, d.version, d.created_at, d.updated_at,
 			   (SELECT COUNT(*) FROM cards WHERE deck_id = d.id) as card_count
 		FROM decks d
 		WHERE d.id = ? AND (d.user_id = ? OR d.public = 1)
-	`, deckID, userID).Scan(&deck.ID, &deck.UserID, &deck.Name, &deck.Description, &deck.Public, &deck.CreatedAt, &deck.UpdatedAt, &deck.CardCount)
+	`, deckID, userID).Scan(&deck.ID, &deck.UserID, &deck.Name, &deck.Description, &deck.Public, &deck.Version, &deck.CreatedAt, &deck.UpdatedAt, &deck.CardCount)
 	if err != nil {
 		http.Error(w, `{"error": "Deck not found"}`, http.StatusNotFound)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(deck)
+	writeConditional(w, r, deck, deck.UpdatedAt, cachePrivate)
 }
 
 func CreateDeck(w http.ResponseWriter, r *http.Request) {
@@ -86,10 +84,11 @@ func CreateDeck(w http.ResponseWriter, r *http.Request) {
 	}
 
 	deckID, _ := result.LastInsertId()
+	invalidateDeckLists(userID)
 
 	var deck models.Deck
-	database.DB.QueryRow("SELECT id, user_id, name, description, public, created_at, updated_at FROM decks WHERE id = ?", deckID).
-		Scan(&deck.ID, &deck.UserID, &deck.Name, &deck.Description, &deck.Public, &deck.CreatedAt, &deck.UpdatedAt)
+	database.DB.QueryRow("SELECT id, user_id, name, description, public, version, created_at, updated_at FROM decks WHERE id = ?", deckID).
+		Scan(&deck.ID, &deck.UserID, &deck.Name, &deck.Description, &deck.Public, &deck.Version, &deck.CreatedAt, &deck.UpdatedAt)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
@@ -115,7 +114,20 @@ func UpdateDeck(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	result, err := database.DB.Exec("UPDATE decks SET name = ?, description = ?, public = ? WHERE id = ? AND user_id = ?", req.Name, req.Description, req.Public, deckID, userID)
+	current, ok := ownedDeck(userID, deckID)
+	if !ok {
+		http.Error(w, `{"error": "Deck not found"}`, http.StatusNotFound)
+		return
+	}
+
+	version, ok := expectedVersion(r, req.Version, current, current.Version)
+	if !ok {
+		http.Error(w, `{"error": "Send If-Match or the version of the deck being edited"}`, http.StatusPreconditionRequired)
+		return
+	}
+
+	result, err := database.DB.Exec("UPDATE decks SET name = ?, description = ?, public = ?, version = version + 1 WHERE id = ? AND user_id = ? AND version = ?",
+		req.Name, req.Description, req.Public, deckID, userID, version)
 	if err != nil {
 		http.Error(w, `{"error": "Failed to update deck"}`, http.StatusInternalServerError)
 		return
@@ -123,13 +135,17 @@ func UpdateDeck(w http.ResponseWriter, r *http.Request) {
 
 	rowsAffected, _ := result.RowsAffected()
 	if rowsAffected == 0 {
-		http.Error(w, `{"error": "Deck not found"}`, http.StatusNotFound)
+		// Someone else saved first, or it was deleted since we looked
+		if current, ok = ownedDeck(userID, deckID); !ok {
+			http.Error(w, `{"error": "Deck not found"}`, http.StatusNotFound)
+			return
+		}
+		writeConflict(w, "This deck was changed by someone else", current)
 		return
 	}
+	invalidateDeck(userID, deckID)
 
-	var deck models.Deck
-	database.DB.QueryRow("SELECT id, user_id, name, description, public, created_at, updated_at FROM decks WHERE id = ?", deckID).
-		Scan(&deck.ID, &deck.UserID, &deck.Name, &deck.Description, &deck.Public, &deck.CreatedAt, &deck.UpdatedAt)
+	deck, _ := ownedDeck(userID, deckID)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(deck)
@@ -154,6 +170,7 @@ func DeleteDeck(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, `{"error": "Deck not found"}`, http.StatusNotFound)
 		return
 	}
+	invalidateDeck(userID, deckID)
 
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -161,26 +178,39 @@ func DeleteDeck(w http.ResponseWriter, r *http.Request) {
 func GetPublicDecks(w http.ResponseWriter, r *http.Request) {
 	userID := middleware.GetUserID(r)
 
-	rows, err := database.DB.Query(`
-		SELECT d.id, d.user_id, d.name, d.description, d.public, d.created_at, d.updated_at,
-			   (SELECT COUNT(*) FROM cards WHERE deck_id = d.id) as card_count
-		FROM decks d
-		WHERE d.public = 1 AND d.user_id != ?
-		ORDER BY d.updated_at DESC
-	`, userID)
+	page, err := parseListPage(r, deckSorts, "updated")
+	if err != nil {
+		http.Error(w, `{"error": "Invalid limit, cursor, sort or order"}`, http.StatusBadRequest)
+		return
+	}
+
+	if page.paginated {
+		decks, next, err := queryDeckPage(page, "d.public = 1 AND d.user_id != ?", userID)
+		if err != nil {
+			http.Error(w, `{"error": "Failed to fetch public decks"}`, http.StatusInternalServerError)
+			return
+		}
+		if next != "" {
+			setNextPage(w, r, next)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(decks)
+		return
+	}
+
+	publicDecks, err := cachedPublicDecks()
 	if err != nil {
 		http.Error(w, `{"error": "Failed to fetch public decks"}`, http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
 
+	// Everyone shares the cached list, so leave out the user's own decks here
 	decks := []models.Deck{}
-	for rows.Next() {
-		var deck models.Deck
-		if err := rows.Scan(&deck.ID, &deck.UserID, &deck.Name, &deck.Description, &deck.Public, &deck.CreatedAt, &deck.UpdatedAt, &deck.CardCount); err != nil {
-			continue
+	for _, deck := range publicDecks {
+		if deck.UserID != userID {
+			decks = append(decks, deck)
 		}
-		decks = append(decks, deck)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -189,30 +219,28 @@ func GetPublicDecks(w http.ResponseWriter, r *http.Request) {
 
 // GetPublicDecksBrowse returns all public decks for unauthenticated browsing
 func GetPublicDecksBrowse(w http.ResponseWriter, r *http.Request) {
-	rows, err := database.DB.Query(`
-		SELECT d.id, d.user_id, d.name, d.description, d.public, d.created_at, d.updated_at,
-			   (SELECT COUNT(*) FROM cards WHERE deck_id = d.id) as card_count
-		FROM decks d
-		WHERE d.public = 1
-		ORDER BY d.updated_at DESC
-	`)
+	page, err := parseListPage(r, deckSorts, "updated")
 	if err != nil {
-		http.Error(w, `{"error": "Failed to fetch public decks"}`, http.StatusInternalServerError)
+		http.Error(w, `{"error": "Invalid limit, cursor, sort or order"}`, http.StatusBadRequest)
 		return
 	}
-	defer rows.Close()
 
-	decks := []models.Deck{}
-	for rows.Next() {
-		var deck models.Deck
-		if err := rows.Scan(&deck.ID, &deck.UserID, &deck.Name, &deck.Description, &deck.Public, &deck.CreatedAt, &deck.UpdatedAt, &deck.CardCount); err != nil {
-			continue
-		}
-		decks = append(decks, deck)
+	var decks []models.Deck
+	var next string
+	if page.paginated {
+		decks, next, err = queryDeckPage(page, "d.public = 1")
+	} else {
+		decks, err = cachedPublicDecks()
+	}
+	if err != nil {
+		http.Error(w, `{"error": "Failed to fetch public decks"}`, http.StatusInternalServerError)
+		return
+	}
+	if next != "" {
+		setNextPage(w, r, next)
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(decks)
+	writeConditional(w, r, decks, time.Time{}, cachePublic)
 }
 
 // GetPublicDeck returns a single public deck for unauthenticated access
@@ -223,20 +251,13 @@ func GetPublicDeck(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var deck models.Deck
-	err = database.DB.QueryRow(`
-		SELECT d.id, d.user_id, d.name, d.description, d.public, d.created_at, d.updated_at,
-			   (SELECT COUNT(*) FROM cards WHERE deck_id = d.id) as card_count
-		FROM decks d
-		WHERE d.id = ? AND d.public = 1
-	`, deckID).Scan(&deck.ID, &deck.UserID, &deck.Name, &deck.Description, &deck.Public, &deck.CreatedAt, &deck.UpdatedAt, &deck.CardCount)
-	if err != nil {
+	deck, ok := cachedPublicDeck(deckID)
+	if !ok {
 		http.Error(w, `{"error": "Deck not found"}`, http.StatusNotFound)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(deck)
+	writeConditional(w, r, deck, deck.UpdatedAt, cachePublic)
 }
 
 // GetPublicDeckCards returns cards for a public deck without authentication
@@ -247,30 +268,34 @@ func GetPublicDeckCards(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	page, err := parseListPage(r, cardSorts, "created")
+	if err != nil {
+		http.Error(w, `{"error": "Invalid limit, cursor, sort or order"}`, http.StatusBadRequest)
+		return
+	}
+
 	// Verify deck is public
-	var isPublic bool
-	err = database.DB.QueryRow("SELECT public FROM decks WHERE id = ?", deckID).Scan(&isPublic)
-	if err != nil || !isPublic {
+	deck, ok := cachedPublicDeck(deckID)
+	if !ok {
 		http.Error(w, `{"error": "Deck not found"}`, http.StatusNotFound)
 		return
 	}
 
-	rows, err := database.DB.Query("SELECT id, deck_id, front, back, created_at, updated_at FROM cards WHERE deck_id = ? ORDER BY created_at", deckID)
+	var cards []models.Card
+	var next string
+	if page.paginated {
+		cards, next, err = queryCardPage(page, deckID)
+	} else {
+		cards, err = deckCards(deckID, true)
+	}
 	if err != nil {
 		http.Error(w, `{"error": "Failed to fetch cards"}`, http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
-
-	cards := []models.Card{}
-	for rows.Next() {
-		var card models.Card
-		if err := rows.Scan(&card.ID, &card.DeckID, &card.Front, &card.Back, &card.CreatedAt, &card.UpdatedAt); err != nil {
-			continue
-		}
-		cards = append(cards, card)
+	if next != "" {
+		setNextPage(w, r, next)
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(cards)
+	// Card changes touch the deck, so its updated_at covers the cards too
+	writeConditional(w, r, cards, deck.UpdatedAt, cachePublic)
 }
@@ -0,0 +1,251 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+
+	"quizzler/cache"
+	"quizzler/database"
+	"quizzler/models"
+)
+
+// How long cached decks and cards live. Writes invalidate them straight
+// away, so this only bounds how stale a missed invalidation can get.
+const deckCacheTTL = 10 * time.Minute
+
+// After this a cached deck or card list is refreshed in the background
+// while the old copy is still served
+const deckCacheSoftTTL = 2 * time.Minute
+
+var errDeckNotFound = errors.New("deck not found")
+
+// cachedUserDecks returns a user's decks, most recently updated first
+func cachedUserDecks(userID int) ([]models.Deck, error) {
+	opts := cache.LoadOptions{TTL: deckCacheTTL, SoftTTL: deckCacheSoftTTL, Tags: []string{cache.UserTag(userID)}}
+	return cache.GetOrLoad(cache.UserDecksKey(userID), opts, func() ([]models.Deck, error) {
+		return queryDecks("WHERE d.user_id = ?", userID)
+	})
+}
+
+// cachedPublicDecks returns every public deck, most recently updated first
+func cachedPublicDecks() ([]models.Deck, error) {
+	opts := cache.LoadOptions{TTL: deckCacheTTL, SoftTTL: deckCacheSoftTTL, Tags: []string{cache.PublicDecksTag()}}
+	return cache.GetOrLoad(cache.PublicDecksKey(), opts, func() ([]models.Deck, error) {
+		return queryDecks("WHERE d.public = 1")
+	})
+}
+
+// cachedPublicDeck returns a deck if it's public, or false
+func cachedPublicDeck(deckID int) (models.Deck, bool) {
+	opts := cache.LoadOptions{TTL: deckCacheTTL, SoftTTL: deckCacheSoftTTL, Tags: []string{cache.DeckTag(deckID)}}
+	deck, err := cache.GetOrLoad(cache.DeckKey(deckID), opts, func() (models.Deck, error) {
+		decks, err := queryDecks("WHERE d.id = ? AND d.public = 1", deckID)
+		if err != nil {
+			return models.Deck{}, err
+		}
+		if len(decks) == 0 {
+			return models.Deck{}, errDeckNotFound
+		}
+		return decks[0], nil
+	})
+	return deck, err == nil
+}
+
+// deckCards returns the cards in a deck with their tags. Only public decks'
+// cards are cached, since they're the ones read over and over.
+func deckCards(deckID int, public bool) ([]models.Card, error) {
+	if !public {
+		return queryDeckCards(deckID)
+	}
+
+	opts := cache.LoadOptions{TTL: deckCacheTTL, SoftTTL: deckCacheSoftTTL, Tags: []string{cache.DeckTag(deckID)}}
+	return cache.GetOrLoad(cache.DeckCardsKey(deckID), opts, func() ([]models.Card, error) {
+		return queryDeckCards(deckID)
+	})
+}
+
+func queryDeckCards(deckID int) ([]models.Card, error) {
+	rows, err := database.DB.Query("SELECT id, deck_id, front, back, version, created_at, updated_at FROM cards WHERE deck_id = ? ORDER BY created_at", deckID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cards := []models.Card{}
+	for rows.Next() {
+		var card models.Card
+		if err := rows.Scan(&card.ID, &card.DeckID, &card.Front, &card.Back, &card.Version, &card.CreatedAt, &card.UpdatedAt); err != nil {
+			continue
+		}
+		cards = append(cards, card)
+	}
+	attachTags(deckID, cards)
+	return cards, nil
+}
+
+// ownedDeck returns one of the user's decks, uncached so it's current
+func ownedDeck(userID, deckID int) (models.Deck, bool) {
+	decks, err := queryDecks("WHERE d.id = ? AND d.user_id = ?", deckID, userID)
+	if err != nil || len(decks) == 0 {
+		return models.Deck{}, false
+	}
+	return decks[0], true
+}
+
+// ownedCard returns one of the user's cards with its tags
+func ownedCard(userID, cardID int) (models.Card, bool) {
+	var card models.Card
+	var deckUserID int
+	err := database.DB.QueryRow(`
+		SELECT c.id, c.deck_id, c.front, c.back, c.version, c.created_at, c.updated_at, d.user_id
+		FROM cards c
+		JOIN decks d ON c.deck_id = d.id
+		WHERE c.id = ?
+	`, cardID).Scan(&card.ID, &card.DeckID, &card.Front, &card.Back, &card.Version, &card.CreatedAt, &card.UpdatedAt, &deckUserID)
+	if err != nil || deckUserID != userID {
+		return models.Card{}, false
+	}
+
+	cards := []models.Card{card}
+	attachTags(card.DeckID, cards)
+	return cards[0], true
+}
+
+func queryDecks(where string, args ...any) ([]models.Deck, error) {
+	rows, err := database.DB.Query(`
+		SELECT d.id, d.user_id, d.name, d.description, d.public, d.version, d.created_at, d.updated_at,
+			   (SELECT COUNT(*) FROM cards WHERE deck_id = d.id) as card_count
+		FROM decks d
+		`+where+`
+		ORDER BY d.updated_at DESC
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	decks := []models.Deck{}
+	for rows.Next() {
+		var deck models.Deck
+		if err := rows.Scan(&deck.ID, &deck.UserID, &deck.Name, &deck.Description, &deck.Public, &deck.Version, &deck.CreatedAt, &deck.UpdatedAt, &deck.CardCount); err != nil {
+			slog.Warn("Failed to scan deck", "error", err)
+			continue
+		}
+		decks = append(decks, deck)
+	}
+	return decks, nil
+}
+
+// queryDeckPage returns one page of the decks matching filter, and the
+// cursor for the next page if there is one
+func queryDeckPage(page listPage, filter string, args ...any) ([]models.Deck, string, error) {
+	where, order, pageArgs, err := page.clause()
+	if err != nil {
+		return nil, "", err
+	}
+
+	rows, err := database.DB.Query(`
+		SELECT id, user_id, name, description, public, version, created_at, updated_at, card_count
+		FROM (
+			SELECT d.id, d.user_id, d.name, d.description, d.public, d.version, d.created_at, d.updated_at,
+				   (SELECT COUNT(*) FROM cards WHERE deck_id = d.id) as card_count
+			FROM decks d
+			WHERE `+filter+`
+		) d
+		WHERE `+where+`
+		`+order, append(args, pageArgs...)...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	decks := []models.Deck{}
+	for rows.Next() {
+		var deck models.Deck
+		if err := rows.Scan(&deck.ID, &deck.UserID, &deck.Name, &deck.Description, &deck.Public, &deck.Version, &deck.CreatedAt, &deck.UpdatedAt, &deck.CardCount); err != nil {
+			slog.Warn("Failed to scan deck", "error", err)
+			continue
+		}
+		decks = append(decks, deck)
+	}
+
+	if len(decks) <= page.limit {
+		return decks, "", nil
+	}
+	decks = decks[:page.limit]
+	last := decks[len(decks)-1]
+
+	var value any
+	switch page.sort.column {
+	case "name":
+		value = last.Name
+	case "created_at":
+		value = last.CreatedAt
+	case "card_count":
+		value = last.CardCount
+	default:
+		value = last.UpdatedAt
+	}
+	return decks, page.nextCursor(value, last.ID), nil
+}
+
+// queryCardPage returns one page of a deck's cards with their tags, and the
+// cursor for the next page if there is one
+func queryCardPage(page listPage, deckID int) ([]models.Card, string, error) {
+	where, order, pageArgs, err := page.clause()
+	if err != nil {
+		return nil, "", err
+	}
+
+	rows, err := database.DB.Query(`
+		SELECT id, deck_id, front, back, version, created_at, updated_at
+		FROM cards
+		WHERE deck_id = ? AND `+where+`
+		`+order, append([]any{deckID}, pageArgs...)...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	cards := []models.Card{}
+	for rows.Next() {
+		var card models.Card
+		if err := rows.Scan(&card.ID, &card.DeckID, &card.Front, &card.Back, &card.Version, &card.CreatedAt, &card.UpdatedAt); err != nil {
+			continue
+		}
+		cards = append(cards, card)
+	}
+
+	next := ""
+	if len(cards) > page.limit {
+		cards = cards[:page.limit]
+		last := cards[len(cards)-1]
+		value := last.CreatedAt
+		if page.sort.column == "updated_at" {
+			value = last.UpdatedAt
+		}
+		next = page.nextCursor(value, last.ID)
+	}
+	attachTags(deckID, cards)
+	return cards, next, nil
+}
+
+// invalidateDeck drops everything cached about a deck after it, or any of
+// its cards, changed. The public list goes too: the deck may have just
+// stopped being public, and card counts are part of the list.
+func invalidateDeck(userID, deckID int) {
+	cache.InvalidateTags(cache.DeckTag(deckID), cache.UserTag(userID), cache.PublicDecksTag())
+}
+
+// cardsChanged bumps a deck's updated_at after its cards changed, so it
+// works as Last-Modified for them, and drops what's cached about the deck
+func cardsChanged(userID, deckID int) {
+	database.DB.Exec("UPDATE decks SET updated_at = NOW() WHERE id = ?", deckID)
+	invalidateDeck(userID, deckID)
+}
+
+// invalidateDeckLists drops a user's deck list and the public deck list
+func invalidateDeckLists(userID int) {
+	cache.InvalidateTags(cache.UserTag(userID), cache.PublicDecksTag())
+}
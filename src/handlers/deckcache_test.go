@@ -0,0 +1,484 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"quizzler/cache"
+	"quizzler/database"
+	"quizzler/middleware"
+	"quizzler/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// These tests run against the in-memory cache, which is what's used when
+// cache.Init hasn't been called, and a mock database.
+
+const (
+	testUserID = 1
+	testDeckID = 10
+	testCardID = 100
+)
+
+var testTime = time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+// deckState is what the cached reads of testDeckID should return. A zero deck
+// means it doesn't exist or isn't public.
+type deckState struct {
+	userDecks   []models.Deck
+	publicDecks []models.Deck
+	deck        models.Deck
+	cards       []models.Card
+}
+
+// newMockDB swaps in a mock database and empties the cache
+func newMockDB(t *testing.T) sqlmock.Sqlmock {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock.New: %v", err)
+	}
+	database.DB = db
+	cache.DeletePattern("*")
+
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+		db.Close()
+		database.DB = nil
+	})
+	return mock
+}
+
+// deckCacheKeys are the keys cached by reading testUserID's decks and testDeckID
+func deckCacheKeys() []string {
+	return []string{cache.UserDecksKey(testUserID), cache.PublicDecksKey(), cache.DeckKey(testDeckID), cache.DeckCardsKey(testDeckID)}
+}
+
+func testDeck(id, userID int, name string, cardCount int) models.Deck {
+	return models.Deck{ID: id, UserID: userID, Name: name, Public: true, CardCount: cardCount, Version: 1, CreatedAt: testTime, UpdatedAt: testTime}
+}
+
+func testCard(id int, front, back string, tags ...string) models.Card {
+	return models.Card{ID: id, DeckID: testDeckID, Front: front, Back: back, Tags: tags, Version: 1, CreatedAt: testTime, UpdatedAt: testTime}
+}
+
+// baseState is testUserID with one public deck of one card
+func baseState() deckState {
+	deck := testDeck(testDeckID, testUserID, "Spanish", 1)
+	return deckState{
+		userDecks:   []models.Deck{deck},
+		publicDecks: []models.Deck{deck},
+		deck:        deck,
+		cards:       []models.Card{testCard(testCardID, "hola", "hello")},
+	}
+}
+
+func deckRows(decks ...models.Deck) *sqlmock.Rows {
+	rows := sqlmock.NewRows([]string{"id", "user_id", "name", "description", "public", "version", "created_at", "updated_at", "card_count"})
+	for _, d := range decks {
+		rows.AddRow(d.ID, d.UserID, d.Name, d.Description, d.Public, d.Version, d.CreatedAt, d.UpdatedAt, d.CardCount)
+	}
+	return rows
+}
+
+func cardRows(cards ...models.Card) *sqlmock.Rows {
+	rows := sqlmock.NewRows([]string{"id", "deck_id", "front", "back", "version", "created_at", "updated_at"})
+	for _, c := range cards {
+		rows.AddRow(c.ID, c.DeckID, c.Front, c.Back, c.Version, c.CreatedAt, c.UpdatedAt)
+	}
+	return rows
+}
+
+// expectOwnedCard sets up the queries made by ownedCard
+func expectOwnedCard(mock sqlmock.Sqlmock, card models.Card) {
+	mock.ExpectQuery(regexp.QuoteMeta("JOIN decks d ON c.deck_id = d.id")).WithArgs(card.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "deck_id", "front", "back", "version", "created_at", "updated_at", "user_id"}).
+			AddRow(card.ID, card.DeckID, card.Front, card.Back, card.Version, card.CreatedAt, card.UpdatedAt, testUserID))
+	mock.ExpectQuery(regexp.QuoteMeta("FROM card_tags ct")).WithArgs(card.DeckID).
+		WillReturnRows(sqlmock.NewRows([]string{"card_id", "name"}))
+}
+
+// expectCardsChanged sets up the deck touch made by cardsChanged
+func expectCardsChanged(mock sqlmock.Sqlmock) {
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE decks SET updated_at = NOW()")).WithArgs(testDeckID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+// expectReads sets up the queries checkReads makes for the keys that aren't cached
+func expectReads(mock sqlmock.Sqlmock, state deckState, uncached []string) {
+	for _, key := range deckCacheKeys() {
+		if !slices.Contains(uncached, key) {
+			continue
+		}
+		switch key {
+		case cache.UserDecksKey(testUserID):
+			mock.ExpectQuery(regexp.QuoteMeta("WHERE d.user_id = ?")).WithArgs(testUserID).
+				WillReturnRows(deckRows(state.userDecks...))
+		case cache.PublicDecksKey():
+			mock.ExpectQuery(regexp.QuoteMeta("WHERE d.public = 1")).
+				WillReturnRows(deckRows(state.publicDecks...))
+		case cache.DeckKey(testDeckID):
+			rows := deckRows()
+			if state.deck.ID != 0 {
+				rows = deckRows(state.deck)
+			}
+			mock.ExpectQuery(regexp.QuoteMeta("WHERE d.id = ? AND d.public = 1")).WithArgs(testDeckID).
+				WillReturnRows(rows)
+		case cache.DeckCardsKey(testDeckID):
+			mock.ExpectQuery(regexp.QuoteMeta("FROM cards WHERE deck_id = ?")).WithArgs(testDeckID).
+				WillReturnRows(cardRows(state.cards...))
+			if len(state.cards) > 0 {
+				tags := sqlmock.NewRows([]string{"card_id", "name"})
+				for _, card := range state.cards {
+					for _, tag := range card.Tags {
+						tags.AddRow(card.ID, tag)
+					}
+				}
+				mock.ExpectQuery(regexp.QuoteMeta("FROM card_tags ct")).WithArgs(testDeckID).WillReturnRows(tags)
+			}
+		}
+	}
+}
+
+// checkReads reads testUserID's decks and testDeckID through the cache and
+// compares them with state
+func checkReads(t *testing.T, state deckState) {
+	t.Helper()
+
+	userDecks, err := cachedUserDecks(testUserID)
+	if err != nil {
+		t.Fatalf("cachedUserDecks: %v", err)
+	}
+	assertSameJSON(t, "user decks", userDecks, state.userDecks)
+
+	publicDecks, err := cachedPublicDecks()
+	if err != nil {
+		t.Fatalf("cachedPublicDecks: %v", err)
+	}
+	assertSameJSON(t, "public decks", publicDecks, state.publicDecks)
+
+	deck, ok := cachedPublicDeck(testDeckID)
+	if ok != (state.deck.ID != 0) {
+		t.Fatalf("cachedPublicDeck found = %v, want %v", ok, !ok)
+	}
+	if ok {
+		assertSameJSON(t, "deck", deck, state.deck)
+	}
+
+	cards, err := deckCards(testDeckID, true)
+	if err != nil {
+		t.Fatalf("deckCards: %v", err)
+	}
+	assertSameJSON(t, "cards", cards, state.cards)
+}
+
+func assertSameJSON(t *testing.T, what string, got, want any) {
+	t.Helper()
+	gotJSON, _ := json.Marshal(got)
+	wantJSON, _ := json.Marshal(want)
+	if !bytes.Equal(gotJSON, wantJSON) {
+		t.Errorf("%s = %s, want %s", what, gotJSON, wantJSON)
+	}
+}
+
+// checkInvalidation caches before, runs write, and checks that it dropped
+// exactly the dropped keys and that reads now return after
+func checkInvalidation(t *testing.T, mock sqlmock.Sqlmock, before, after deckState, dropped []string, write func()) {
+	t.Helper()
+
+	expectReads(mock, before, deckCacheKeys())
+	checkReads(t, before)
+	for _, key := range deckCacheKeys() {
+		if !cache.Exists(key) {
+			t.Fatalf("%s wasn't cached", key)
+		}
+	}
+
+	write()
+
+	for _, key := range deckCacheKeys() {
+		if want := !slices.Contains(dropped, key); cache.Exists(key) != want {
+			t.Errorf("%s cached = %v after the write, want %v", key, !want, want)
+		}
+	}
+
+	expectReads(mock, after, dropped)
+	checkReads(t, after)
+}
+
+// serve routes a request to a handler registered at pattern, the route from
+// main.go, as testUserID. Like main.go the API is served under /api.
+func serve(handler http.HandlerFunc, pattern, target string, body io.Reader) *httptest.ResponseRecorder {
+	api := http.NewServeMux()
+	api.Handle(pattern, handler)
+	mux := http.NewServeMux()
+	mux.Handle("/api/", http.StripPrefix("/api", api))
+
+	method, _, _ := strings.Cut(pattern, " ")
+	r := httptest.NewRequest(method, target, body)
+	r = r.WithContext(context.WithValue(r.Context(), middleware.UserIDKey, testUserID))
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	return w
+}
+
+func checkStatus(t *testing.T, w *httptest.ResponseRecorder, want int) {
+	t.Helper()
+	if w.Code != want {
+		t.Fatalf("status = %d, want %d: %s", w.Code, want, w.Body.String())
+	}
+}
+
+func TestCreateDeckInvalidatesDeckLists(t *testing.T) {
+	mock := newMockDB(t)
+	before := baseState()
+	created := testDeck(11, testUserID, "French", 0)
+	after := before
+	after.userDecks = []models.Deck{created, before.deck}
+	after.publicDecks = []models.Deck{created, before.deck}
+
+	dropped := []string{cache.UserDecksKey(testUserID), cache.PublicDecksKey()}
+	checkInvalidation(t, mock, before, after, dropped, func() {
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO decks")).WithArgs(testUserID, "French", "", true).
+			WillReturnResult(sqlmock.NewResult(11, 1))
+		mock.ExpectQuery(regexp.QuoteMeta("FROM decks WHERE id = ?")).WithArgs(11).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "name", "description", "public", "version", "created_at", "updated_at"}).
+				AddRow(11, testUserID, "French", "", true, 1, testTime, testTime))
+
+		w := serve(CreateDeck, "POST /decks", "/api/decks", strings.NewReader(`{"name": "French", "public": true}`))
+		checkStatus(t, w, http.StatusCreated)
+	})
+}
+
+func TestUpdateDeckInvalidatesDeck(t *testing.T) {
+	mock := newMockDB(t)
+	before := baseState()
+	renamed := before.deck
+	renamed.Name = "Castellano"
+	renamed.Version = 2
+	after := before
+	after.userDecks = []models.Deck{renamed}
+	after.publicDecks = []models.Deck{renamed}
+	after.deck = renamed
+
+	checkInvalidation(t, mock, before, after, deckCacheKeys(), func() {
+		mock.ExpectQuery(regexp.QuoteMeta("WHERE d.id = ? AND d.user_id = ?")).WithArgs(testDeckID, testUserID).
+			WillReturnRows(deckRows(before.deck))
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE decks SET name = ?")).WithArgs("Castellano", "", true, testDeckID, testUserID, 1).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectQuery(regexp.QuoteMeta("WHERE d.id = ? AND d.user_id = ?")).WithArgs(testDeckID, testUserID).
+			WillReturnRows(deckRows(renamed))
+
+		w := serve(UpdateDeck, "PUT /decks/{id}", "/api/decks/10", strings.NewReader(`{"name": "Castellano", "public": true, "version": 1}`))
+		checkStatus(t, w, http.StatusOK)
+	})
+}
+
+func TestDeleteDeckInvalidatesDeck(t *testing.T) {
+	mock := newMockDB(t)
+	after := deckState{userDecks: []models.Deck{}, publicDecks: []models.Deck{}, cards: []models.Card{}}
+
+	checkInvalidation(t, mock, baseState(), after, deckCacheKeys(), func() {
+		mock.ExpectExec(regexp.QuoteMeta("DELETE FROM decks")).WithArgs(testDeckID, testUserID).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		w := serve(DeleteDeck, "DELETE /decks/{id}", "/api/decks/10", nil)
+		checkStatus(t, w, http.StatusNoContent)
+	})
+}
+
+// withCards is state after a write left testDeckID with cards
+func withCards(state deckState, cards ...models.Card) deckState {
+	deck := state.deck
+	deck.CardCount = len(cards)
+	state.userDecks = []models.Deck{deck}
+	state.publicDecks = []models.Deck{deck}
+	state.deck = deck
+	state.cards = cards
+	return state
+}
+
+func TestCreateCardInvalidatesDeck(t *testing.T) {
+	mock := newMockDB(t)
+	before := baseState()
+	created := testCard(101, "adiós", "goodbye")
+	after := withCards(before, before.cards[0], created)
+
+	checkInvalidation(t, mock, before, after, deckCacheKeys(), func() {
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT user_id FROM decks WHERE id = ?")).WithArgs(testDeckID).
+			WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(testUserID))
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO cards")).WithArgs(testDeckID, "adiós", "goodbye", sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(101, 1))
+		expectCardsChanged(mock)
+		mock.ExpectQuery(regexp.QuoteMeta("FROM cards WHERE id = ?")).WithArgs(101).
+			WillReturnRows(cardRows(created))
+
+		w := serve(CreateCard, "POST /decks/{deckId}/cards", "/api/decks/10/cards", strings.NewReader(`{"front": "adiós", "back": "goodbye"}`))
+		checkStatus(t, w, http.StatusCreated)
+	})
+}
+
+func TestCreateSkippedCardKeepsCache(t *testing.T) {
+	mock := newMockDB(t)
+	before := baseState()
+
+	checkInvalidation(t, mock, before, before, nil, func() {
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT user_id FROM decks WHERE id = ?")).WithArgs(testDeckID).
+			WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(testUserID))
+		mock.ExpectQuery(regexp.QuoteMeta("WHERE deck_id = ? AND content_hash = ?")).WithArgs(testDeckID, sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testCardID))
+		mock.ExpectQuery(regexp.QuoteMeta("FROM cards WHERE id = ?")).WithArgs(testCardID).
+			WillReturnRows(cardRows(before.cards[0]))
+
+		w := serve(CreateCard, "POST /decks/{deckId}/cards", "/api/decks/10/cards", strings.NewReader(`{"front": "hola", "back": "hello", "duplicates": "skip"}`))
+		checkStatus(t, w, http.StatusOK)
+	})
+}
+
+func TestUpdateCardInvalidatesDeck(t *testing.T) {
+	mock := newMockDB(t)
+	before := baseState()
+	edited := before.cards[0]
+	edited.Back = "hi"
+	edited.Version = 2
+	after := withCards(before, edited)
+
+	checkInvalidation(t, mock, before, after, deckCacheKeys(), func() {
+		expectOwnedCard(mock, before.cards[0])
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE cards SET front = ?")).
+			WithArgs("hola", "hi", sqlmock.AnyArg(), sqlmock.AnyArg(), testCardID, 1).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		expectCardsChanged(mock)
+		expectOwnedCard(mock, edited)
+
+		w := serve(UpdateCard, "PUT /cards/{id}", "/api/cards/100", strings.NewReader(`{"front": "hola", "back": "hi", "version": 1}`))
+		checkStatus(t, w, http.StatusOK)
+	})
+}
+
+func TestDeleteCardInvalidatesDeck(t *testing.T) {
+	mock := newMockDB(t)
+	before := baseState()
+	after := withCards(before)
+	after.cards = []models.Card{}
+
+	checkInvalidation(t, mock, before, after, deckCacheKeys(), func() {
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT c.deck_id, d.user_id FROM cards c")).WithArgs(testCardID).
+			WillReturnRows(sqlmock.NewRows([]string{"deck_id", "user_id"}).AddRow(testDeckID, testUserID))
+		mock.ExpectExec(regexp.QuoteMeta("DELETE FROM cards WHERE id = ?")).WithArgs(testCardID).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		expectCardsChanged(mock)
+
+		w := serve(DeleteCard, "DELETE /cards/{id}", "/api/cards/100", nil)
+		checkStatus(t, w, http.StatusNoContent)
+	})
+}
+
+func TestImportCardsInvalidatesDeck(t *testing.T) {
+	mock := newMockDB(t)
+	before := baseState()
+	after := withCards(before, before.cards[0], testCard(101, "adiós", "goodbye"), testCard(102, "gracias", "thanks"))
+
+	checkInvalidation(t, mock, before, after, deckCacheKeys(), func() {
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT user_id FROM decks WHERE id = ?")).WithArgs(testDeckID).
+			WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(testUserID))
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO cards")).WithArgs(testDeckID, "adiós", "goodbye", sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(101, 1))
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO cards")).WithArgs(testDeckID, "gracias", "thanks", sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(102, 1))
+		expectCardsChanged(mock)
+
+		body := `{"cards": [{"front": "adiós", "back": "goodbye"}, {"front": "gracias", "back": "thanks"}]}`
+		w := serve(ImportCards, "POST /decks/{deckId}/cards/import", "/api/decks/10/cards/import", strings.NewReader(body))
+		checkStatus(t, w, http.StatusOK)
+	})
+}
+
+func TestImportNotesInvalidatesDeck(t *testing.T) {
+	mock := newMockDB(t)
+	before := baseState()
+	after := withCards(before, before.cards[0], testCard(101, "adiós", "goodbye", "spanish.md"))
+
+	checkInvalidation(t, mock, before, after, deckCacheKeys(), func() {
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT id FROM decks WHERE user_id = ? AND name = ?")).WithArgs(testUserID, "Spanish").
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testDeckID))
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO tags")).WithArgs(testUserID, "spanish.md").
+			WillReturnResult(sqlmock.NewResult(5, 1))
+		mock.ExpectQuery(regexp.QuoteMeta("JOIN card_tags ct ON ct.card_id = c.id")).WithArgs(testDeckID, sqlmock.AnyArg(), 5).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "content_hash"}))
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO cards")).WithArgs(testDeckID, "adiós", "goodbye", sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(101, 1))
+		mock.ExpectExec(regexp.QuoteMeta("INSERT IGNORE INTO card_tags")).WithArgs(101, 5).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		expectCardsChanged(mock)
+
+		w := serve(ImportNotes, "POST /decks/import/notes", "/api/decks/import/notes?filename=spanish.md", strings.NewReader("# Spanish\n\nadiós :: goodbye\n"))
+		checkStatus(t, w, http.StatusOK)
+	})
+}
+
+func TestImportAccountInvalidatesDeckLists(t *testing.T) {
+	mock := newMockDB(t)
+	// testDeckID belongs to someone else, since backups only restore into accounts without decks
+	other := testDeck(testDeckID, 2, "Spanish", 1)
+	before := deckState{
+		userDecks:   []models.Deck{},
+		publicDecks: []models.Deck{other},
+		deck:        other,
+		cards:       baseState().cards,
+	}
+	restored := testDeck(11, testUserID, "Restored", 1)
+	after := before
+	after.userDecks = []models.Deck{restored}
+	after.publicDecks = []models.Deck{restored, other}
+
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	f, _ := zw.Create(backupFileName)
+	json.NewEncoder(f).Encode(models.Backup{
+		Version: models.BackupVersion,
+		Decks: []models.BackupDeck{{
+			ID: 1, Name: "Restored", Public: true, CreatedAt: testTime, UpdatedAt: testTime,
+			Cards: []models.BackupCard{{Front: "hola", Back: "hello", Tags: []string{"greetings"}}},
+		}},
+	})
+	zw.Close()
+
+	dropped := []string{cache.UserDecksKey(testUserID), cache.PublicDecksKey()}
+	checkInvalidation(t, mock, before, after, dropped, func() {
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM decks WHERE user_id = ?")).WithArgs(testUserID).
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+		mock.ExpectBegin()
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT id FROM users WHERE id = ? FOR UPDATE")).WithArgs(testUserID).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testUserID))
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM decks WHERE user_id = ?")).WithArgs(testUserID).
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO decks")).
+			WithArgs(testUserID, "Restored", "", true, sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(11, 1))
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO cards")).
+			WithArgs(11, "hola", "hello", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(200, 1))
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO tags")).WithArgs(testUserID, "greetings").
+			WillReturnResult(sqlmock.NewResult(7, 1))
+		mock.ExpectExec(regexp.QuoteMeta("INSERT IGNORE INTO card_tags")).WithArgs(200, 7).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		w := serve(ImportAccount, "POST /me/import", "/api/me/import", &archive)
+		checkStatus(t, w, http.StatusOK)
+	})
+}
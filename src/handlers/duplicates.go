@@ -0,0 +1,206 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"quizzler/database"
+	"quizzler/middleware"
+	"quizzler/models"
+)
+
+// Duplicate policies accepted by CreateCard and ImportCards
+const (
+	DuplicatesAllow  = "allow"
+	DuplicatesSkip   = "skip"
+	DuplicatesUpdate = "update"
+)
+
+type cardWriteResult int
+
+const (
+	cardCreated cardWriteResult = iota
+	cardUpdated
+	cardSkipped
+)
+
+// normalizeCardText strips punctuation, lowercases and collapses whitespace.
+// Only Unicode punctuation goes; symbols like $+<=>^`|~ are kept.
+func normalizeCardText(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsPunct(r) {
+			return -1
+		}
+		return r
+	}, s)
+	return strings.Join(strings.Fields(strings.ToLower(s)), " ")
+}
+
+// cardHashes returns the hash of the normalized front, and of the normalized front and back together
+func cardHashes(front, back string) (string, string) {
+	f := normalizeCardText(front)
+	frontSum := sha256.Sum256([]byte(f))
+	contentSum := sha256.Sum256([]byte(f + "\n" + normalizeCardText(back)))
+	return hex.EncodeToString(frontSum[:]), hex.EncodeToString(contentSum[:])
+}
+
+// BackfillCardHashes hashes cards that don't have hashes yet, in batches.
+// It runs at startup so existing cards get exactly the hashes new ones would.
+func BackfillCardHashes() error {
+	const batchSize = 500
+	total := 0
+	for {
+		rows, err := database.DB.Query("SELECT id, front, back FROM cards WHERE front_hash IS NULL OR content_hash IS NULL LIMIT ?", batchSize)
+		if err != nil {
+			return err
+		}
+
+		type pending struct {
+			id          int
+			front, back string
+		}
+		var cards []pending
+		for rows.Next() {
+			var card pending
+			if err := rows.Scan(&card.id, &card.front, &card.back); err != nil {
+				rows.Close()
+				return err
+			}
+			cards = append(cards, card)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, card := range cards {
+			frontHash, contentHash := cardHashes(card.front, card.back)
+			if _, err := database.DB.Exec("UPDATE cards SET front_hash = ?, content_hash = ?, updated_at = updated_at WHERE id = ?", frontHash, contentHash, card.id); err != nil {
+				return err
+			}
+		}
+		total += len(cards)
+
+		if len(cards) < batchSize {
+			if total > 0 {
+				slog.Info("Backfilled card hashes", "cards", total)
+			}
+			return nil
+		}
+	}
+}
+
+// parseDuplicatePolicy validates a policy, defaulting to allow when empty
+func parseDuplicatePolicy(policy string) (string, bool) {
+	switch policy {
+	case "":
+		return DuplicatesAllow, true
+	case DuplicatesAllow, DuplicatesSkip, DuplicatesUpdate:
+		return policy, true
+	}
+	return "", false
+}
+
+// writeCard inserts a card into a deck, honouring the duplicate policy.
+// skip leaves an existing card with the same normalized content alone;
+// update overwrites the first card with the same normalized front.
+func writeCard(deckID int, front, back, policy string) (int, cardWriteResult, error) {
+	frontHash, contentHash := cardHashes(front, back)
+
+	switch policy {
+	case DuplicatesSkip:
+		var existingID int
+		err := database.DB.QueryRow("SELECT id FROM cards WHERE deck_id = ? AND content_hash = ? ORDER BY id LIMIT 1", deckID, contentHash).Scan(&existingID)
+		if err == nil {
+			return existingID, cardSkipped, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return 0, 0, err
+		}
+
+	case DuplicatesUpdate:
+		var existingID int
+		var existingHash sql.NullString
+		err := database.DB.QueryRow("SELECT id, content_hash FROM cards WHERE deck_id = ? AND front_hash = ? ORDER BY id LIMIT 1", deckID, frontHash).Scan(&existingID, &existingHash)
+		if err == nil {
+			if existingHash.String == contentHash {
+				return existingID, cardSkipped, nil
+			}
+			_, err = database.DB.Exec("UPDATE cards SET front = ?, back = ?, front_hash = ?, content_hash = ?, version = version + 1 WHERE id = ?", front, back, frontHash, contentHash, existingID)
+			if err != nil {
+				return 0, 0, err
+			}
+			return existingID, cardUpdated, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return 0, 0, err
+		}
+	}
+
+	result, err := database.DB.Exec("INSERT INTO cards (deck_id, front, back, front_hash, content_hash) VALUES (?, ?, ?, ?, ?)", deckID, front, back, frontHash, contentHash)
+	if err != nil {
+		return 0, 0, err
+	}
+	cardID, _ := result.LastInsertId()
+	return int(cardID), cardCreated, nil
+}
+
+// GetDuplicates returns groups of cards in a deck that share the same normalized front
+func GetDuplicates(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.GetUserID(r)
+	deckID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, `{"error": "Invalid deck ID"}`, http.StatusBadRequest)
+		return
+	}
+
+	// Verify deck belongs to user
+	var deckUserID int
+	err = database.DB.QueryRow("SELECT user_id FROM decks WHERE id = ?", deckID).Scan(&deckUserID)
+	if err != nil || deckUserID != userID {
+		http.Error(w, `{"error": "Deck not found"}`, http.StatusNotFound)
+		return
+	}
+
+	rows, err := database.DB.Query(`
+		SELECT c.id, c.deck_id, c.front, c.back, c.front_hash, c.version, c.created_at, c.updated_at
+		FROM cards c
+		JOIN (
+			SELECT front_hash FROM cards
+			WHERE deck_id = ? AND front_hash IS NOT NULL
+			GROUP BY front_hash
+			HAVING COUNT(*) > 1
+		) dup ON dup.front_hash = c.front_hash
+		WHERE c.deck_id = ?
+		ORDER BY c.front_hash, c.created_at
+	`, deckID, deckID)
+	if err != nil {
+		http.Error(w, `{"error": "Failed to fetch duplicates"}`, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	groups := []models.DuplicateGroup{}
+	for rows.Next() {
+		var card models.Card
+		var frontHash string
+		if err := rows.Scan(&card.ID, &card.DeckID, &card.Front, &card.Back, &frontHash, &card.Version, &card.CreatedAt, &card.UpdatedAt); err != nil {
+			continue
+		}
+		if len(groups) == 0 || groups[len(groups)-1].FrontHash != frontHash {
+			groups = append(groups, models.DuplicateGroup{FrontHash: frontHash})
+		}
+		groups[len(groups)-1].Cards = append(groups[len(groups)-1].Cards, card)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(groups)
+}
@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+
+	"quizzler/database"
+	"quizzler/mailer"
+	"quizzler/models"
+)
+
+// requireEmailVerification reports whether unverified accounts are blocked from logging in
+func requireEmailVerification() bool {
+	return os.Getenv("REQUIRE_EMAIL_VERIFICATION") == "true"
+}
+
+// sendVerificationEmail emails a link confirming the user owns their address
+func sendVerificationEmail(userID int, email string) {
+	token, err := createUserToken(userID, tokenVerifyEmail, "", verifyEmailTTL)
+	if err != nil {
+		slog.Error("Failed to create verification token", "user_id", userID, "error", err)
+		return
+	}
+
+	mailer.SendAsync(mailer.Message{
+		To:      email,
+		Subject: "Confirm your Quizzler email address",
+		Body: fmt.Sprintf("Welcome to Quizzler!\n\n"+
+			"Open this link to confirm your email address:\n%s/verify-email?token=%s\n",
+			mailer.AppURL(), url.QueryEscape(token)),
+	})
+}
+
+// VerifyEmail marks the account's email address as verified
+func VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var req models.VerifyEmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	if req.Token == "" {
+		http.Error(w, `{"error": "Token is required"}`, http.StatusBadRequest)
+		return
+	}
+
+	userID, _, err := consumeUserToken(req.Token, tokenVerifyEmail)
+	if err != nil {
+		http.Error(w, `{"error": "Invalid or expired verification token"}`, http.StatusBadRequest)
+		return
+	}
+
+	_, err = database.DB.Exec("UPDATE users SET email_verified_at = NOW() WHERE id = ? AND email_verified_at IS NULL", userID)
+	if err != nil {
+		http.Error(w, `{"error": "Failed to verify email"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ResendVerification sends a new verification link. It responds the same way
+// whether or not the address belongs to an unverified account.
+func ResendVerification(w http.ResponseWriter, r *http.Request) {
+	var req models.EmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	if req.Email == "" {
+		http.Error(w, `{"error": "Email is required"}`, http.StatusBadRequest)
+		return
+	}
+
+	var userID int
+	var email string
+	err := database.DB.QueryRow("SELECT id, email FROM users WHERE email = ? AND email_verified_at IS NULL", req.Email).Scan(&userID, &email)
+	if err == nil {
+		sendVerificationEmail(userID, email)
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(`{"message": "If that address needs verifying, a new link has been sent"}`))
+}
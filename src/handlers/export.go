@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"quizzler/database"
+	"quizzler/export"
+	"quizzler/middleware"
+	"quizzler/models"
+)
+
+var unsafeFilenameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// loadExportDeck fetches a deck the user owns or that is public, along with its cards
+func loadExportDeck(w http.ResponseWriter, r *http.Request) (models.Deck, []models.Card, bool) {
+	userID := middleware.GetUserID(r)
+	deckID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, `{"error": "Invalid deck ID"}`, http.StatusBadRequest)
+		return models.Deck{}, nil, false
+	}
+
+	var deck models.Deck
+	err = database.DB.QueryRow(`
+		SELECT id, user_id, name, description, public, created_at, updated_at
+		FROM decks
+		WHERE id = ? AND (user_id = ? OR public = 1)
+	`, deckID, userID).Scan(&deck.ID, &deck.UserID, &deck.Name, &deck.Description, &deck.Public, &deck.CreatedAt, &deck.UpdatedAt)
+	if err != nil {
+		http.Error(w, `{"error": "Deck not found"}`, http.StatusNotFound)
+		return models.Deck{}, nil, false
+	}
+
+	rows, err := database.DB.Query("SELECT id, deck_id, front, back, created_at, updated_at FROM cards WHERE deck_id = ? ORDER BY created_at", deckID)
+	if err != nil {
+		http.Error(w, `{"error": "Failed to fetch cards"}`, http.StatusInternalServerError)
+		return models.Deck{}, nil, false
+	}
+	defer rows.Close()
+
+	cards := []models.Card{}
+	for rows.Next() {
+		var card models.Card
+		if err := rows.Scan(&card.ID, &card.DeckID, &card.Front, &card.Back, &card.CreatedAt, &card.UpdatedAt); err != nil {
+			continue
+		}
+		cards = append(cards, card)
+	}
+	deck.CardCount = len(cards)
+
+	return deck, cards, true
+}
+
+// exportFilename builds a download filename from the deck name
+func exportFilename(deck models.Deck, ext string) string {
+	name := strings.Trim(unsafeFilenameChars.ReplaceAllString(deck.Name, "-"), "-")
+	if name == "" {
+		name = fmt.Sprintf("deck-%d", deck.ID)
+	}
+	return name + "." + ext
+}
+
+func setDownloadHeaders(w http.ResponseWriter, contentType, filename string) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+}
+
+// ExportDeckMarkdown renders a deck as a Markdown table, or a list with ?style=list
+func ExportDeckMarkdown(w http.ResponseWriter, r *http.Request) {
+	style := r.URL.Query().Get("style")
+	if style == "" {
+		style = export.MarkdownTable
+	}
+	if style != export.MarkdownTable && style != export.MarkdownList {
+		http.Error(w, `{"error": "Invalid style"}`, http.StatusBadRequest)
+		return
+	}
+
+	deck, cards, ok := loadExportDeck(w, r)
+	if !ok {
+		return
+	}
+
+	setDownloadHeaders(w, "text/markdown; charset=utf-8", exportFilename(deck, "md"))
+	w.Write([]byte(export.Markdown(deck, cards, style)))
+}
+
+// ExportDeckPDF renders a deck as double-sided printable flashcards
+func ExportDeckPDF(w http.ResponseWriter, r *http.Request) {
+	deck, cards, ok := loadExportDeck(w, r)
+	if !ok {
+		return
+	}
+
+	setDownloadHeaders(w, "application/pdf", exportFilename(deck, "pdf"))
+	w.Write(export.PDF(deck, cards))
+}
+
+// parseQuizOptions reads ?type=short|choice and ?choices=N
+func parseQuizOptions(r *http.Request) (export.QuizOptions, bool) {
+	opts := export.QuizOptions{
+		Type:    r.URL.Query().Get("type"),
+		Choices: export.DefaultChoices,
+	}
+	if opts.Type == "" {
+		opts.Type = export.QuestionShortAnswer
+	}
+	if opts.Type != export.QuestionShortAnswer && opts.Type != export.QuestionMultipleChoice {
+		return opts, false
+	}
+
+	if c := r.URL.Query().Get("choices"); c != "" {
+		n, err := strconv.Atoi(c)
+		if err != nil || n < 2 || n > export.MaxChoices {
+			return opts, false
+		}
+		opts.Choices = n
+	}
+	return opts, true
+}
+
+// ExportDeckGIFT renders a deck as Moodle GIFT questions
+func ExportDeckGIFT(w http.ResponseWriter, r *http.Request) {
+	opts, ok := parseQuizOptions(r)
+	if !ok {
+		http.Error(w, `{"error": "Invalid quiz options"}`, http.StatusBadRequest)
+		return
+	}
+
+	deck, cards, ok := loadExportDeck(w, r)
+	if !ok {
+		return
+	}
+
+	setDownloadHeaders(w, "text/plain; charset=utf-8", exportFilename(deck, "gift.txt"))
+	w.Write([]byte(export.GIFT(deck, cards, opts)))
+}
+
+// ExportDeckQTI renders a deck as an IMS QTI 2.1 package
+func ExportDeckQTI(w http.ResponseWriter, r *http.Request) {
+	opts, ok := parseQuizOptions(r)
+	if !ok {
+		http.Error(w, `{"error": "Invalid quiz options"}`, http.StatusBadRequest)
+		return
+	}
+
+	deck, cards, ok := loadExportDeck(w, r)
+	if !ok {
+		return
+	}
+
+	data, err := export.QTI(deck, cards, opts)
+	if err != nil {
+		http.Error(w, `{"error": "Failed to build QTI package"}`, http.StatusInternalServerError)
+		return
+	}
+
+	setDownloadHeaders(w, "application/zip", exportFilename(deck, "qti.zip"))
+	w.Write(data)
+}
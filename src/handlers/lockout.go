@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"quizzler/database"
+	"quizzler/middleware"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// Failed attempts allowed before an email is locked out
+	lockoutThreshold = 5
+	// The first lockout lasts lockoutBase, doubling with each further failure up to lockoutMax
+	lockoutBase = time.Minute
+	lockoutMax  = time.Hour
+	// The failure count starts over once an email has gone this long without one
+	lockoutResetAfter = 24 * time.Hour
+)
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     []byte
+)
+
+// loginKey identifies an email for failed login tracking
+func loginKey(email string) string {
+	return middleware.HashToken(strings.ToLower(strings.TrimSpace(email)))
+}
+
+// lockoutDuration is how long an email is locked after a number of failures
+func lockoutDuration(failures int) time.Duration {
+	if failures < lockoutThreshold {
+		return 0
+	}
+	shift := failures - lockoutThreshold
+	if shift >= 6 {
+		return lockoutMax
+	}
+	return min(lockoutBase<<shift, lockoutMax)
+}
+
+// loginLockedFor returns how much longer logins for an email are locked, or 0
+func loginLockedFor(email string) time.Duration {
+	var lockedUntil sql.NullTime
+	err := database.DB.QueryRow("SELECT locked_until FROM login_failures WHERE email_hash = ?", loginKey(email)).Scan(&lockedUntil)
+	if err != nil || !lockedUntil.Valid {
+		return 0
+	}
+	return max(time.Until(lockedUntil.Time), 0)
+}
+
+// recordLoginFailure counts a failed login for an email, locking it once
+// there have been too many. userID is 0 if no account has the email.
+func recordLoginFailure(r *http.Request, email string, userID int) {
+	key := loginKey(email)
+	_, err := database.DB.Exec(`
+		INSERT INTO login_failures (email_hash, failures, last_failed_at) VALUES (?, 1, NOW())
+		ON DUPLICATE KEY UPDATE
+			failures = IF(last_failed_at < NOW() - INTERVAL ? SECOND, 1, failures + 1),
+			last_failed_at = NOW()
+	`, key, int(lockoutResetAfter.Seconds()))
+	if err != nil {
+		slog.Error("Failed to record login failure", "error", err)
+		return
+	}
+
+	var failures int
+	if err := database.DB.QueryRow("SELECT failures FROM login_failures WHERE email_hash = ?", key).Scan(&failures); err != nil {
+		return
+	}
+
+	duration := lockoutDuration(failures)
+	if duration == 0 {
+		return
+	}
+
+	database.DB.Exec("UPDATE login_failures SET locked_until = NOW() + INTERVAL ? SECOND WHERE email_hash = ?", int(duration.Seconds()), key)
+	recordAuditEvent(r, userID, auditLoginLocked, fmt.Sprintf("%d failed attempts, locked for %s", failures, duration))
+}
+
+// clearLoginFailures resets the failure count for an email, returning whether it was locked
+func clearLoginFailures(email string) bool {
+	key := loginKey(email)
+	locked := loginLockedFor(email) > 0
+	database.DB.Exec("DELETE FROM login_failures WHERE email_hash = ?", key)
+	return locked
+}
+
+// writeLockedOut responds to a login attempt for a locked email
+func writeLockedOut(w http.ResponseWriter, remaining time.Duration) {
+	w.Header().Set("Retry-After", fmt.Sprintf("%d", int(remaining.Seconds())+1))
+	http.Error(w, `{"error": "Too many failed login attempts, try again later"}`, http.StatusTooManyRequests)
+}
+
+// burnPasswordCheck does the same bcrypt work as a real password check so a
+// login for an unknown email takes as long as one with a wrong password
+func burnPasswordCheck(password string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("quizzler-dummy-password"), bcrypt.DefaultCost)
+	})
+	bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+}
@@ -0,0 +1,172 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"path"
+
+	"quizzler/database"
+	"quizzler/importer"
+	"quizzler/middleware"
+	"quizzler/models"
+)
+
+const maxNotesSize = 16 << 20
+
+// ImportNotes extracts cards from a Markdown file or a ZIP of Markdown files
+// sent as the request body. Headings pick the deck, creating it if needed, and
+// every card is tagged with its source file so re-importing the same file
+// updates cards rather than duplicating them.
+func ImportNotes(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.GetUserID(r)
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxNotesSize))
+	if err != nil {
+		http.Error(w, `{"error": "Upload is too large"}`, http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var sections []importer.Section
+	if importer.IsZip(data) {
+		sections, err = importer.MarkdownZip(data)
+		if errors.Is(err, importer.ErrArchiveTooLarge) {
+			http.Error(w, `{"error": "Upload is too large"}`, http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			http.Error(w, `{"error": "Invalid ZIP archive"}`, http.StatusBadRequest)
+			return
+		}
+	} else {
+		filename := path.Base(r.URL.Query().Get("filename"))
+		if filename == "." || filename == "/" {
+			filename = "notes.md"
+		}
+		sections = importer.Markdown(filename, string(data))
+	}
+
+	if len(sections) == 0 {
+		http.Error(w, `{"error": "No cards found"}`, http.StatusBadRequest)
+		return
+	}
+
+	var resp models.ImportNotesResponse
+	deckIDs := map[string]int{}
+	tagIDs := map[string]int{}
+	// Called before any response is written, so the client never reads a
+	// cached deck from before the import
+	changed := func() {
+		for _, deckID := range deckIDs {
+			cardsChanged(userID, deckID)
+		}
+	}
+
+	for _, section := range sections {
+		deckID, ok := deckIDs[section.Deck]
+		if !ok {
+			var created bool
+			deckID, created, err = findOrCreateDeck(userID, section.Deck)
+			if err != nil {
+				changed()
+				http.Error(w, `{"error": "Failed to create deck"}`, http.StatusInternalServerError)
+				return
+			}
+			deckIDs[section.Deck] = deckID
+			if created {
+				resp.DecksCreated++
+			}
+		}
+
+		tagID, ok := tagIDs[section.File]
+		if !ok {
+			tagID, err = ensureTag(database.DB, userID, section.File)
+			if err != nil {
+				changed()
+				http.Error(w, `{"error": "Failed to create tag"}`, http.StatusInternalServerError)
+				return
+			}
+			tagIDs[section.File] = tagID
+		}
+
+		for _, card := range section.Cards {
+			outcome, err := writeSourcedCard(deckID, tagID, card.Front, card.Back)
+			if err != nil {
+				continue
+			}
+			switch outcome {
+			case cardCreated:
+				resp.Imported++
+			case cardUpdated:
+				resp.Updated++
+			case cardSkipped:
+				resp.Skipped++
+			}
+		}
+	}
+
+	changed()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// findOrCreateDeck returns the user's deck with the given name, creating it if it doesn't exist
+func findOrCreateDeck(userID int, name string) (int, bool, error) {
+	var deckID int
+	err := database.DB.QueryRow("SELECT id FROM decks WHERE user_id = ? AND name = ? ORDER BY id LIMIT 1", userID, name).Scan(&deckID)
+	if err == nil {
+		return deckID, false, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return 0, false, err
+	}
+
+	result, err := database.DB.Exec("INSERT INTO decks (user_id, name, description, public) VALUES (?, ?, '', 0)", userID, name)
+	if err != nil {
+		return 0, false, err
+	}
+	newID, _ := result.LastInsertId()
+	return int(newID), true, nil
+}
+
+// writeSourcedCard updates the card with the same front that came from the
+// same source tag, or inserts and tags a new one
+func writeSourcedCard(deckID, tagID int, front, back string) (cardWriteResult, error) {
+	frontHash, contentHash := cardHashes(front, back)
+
+	var existingID int
+	var existingHash sql.NullString
+	err := database.DB.QueryRow(`
+		SELECT c.id, c.content_hash
+		FROM cards c
+		JOIN card_tags ct ON ct.card_id = c.id
+		WHERE c.deck_id = ? AND c.front_hash = ? AND ct.tag_id = ?
+		ORDER BY c.id
+		LIMIT 1
+	`, deckID, frontHash, tagID).Scan(&existingID, &existingHash)
+	if err == nil {
+		if existingHash.String == contentHash {
+			return cardSkipped, nil
+		}
+		_, err = database.DB.Exec("UPDATE cards SET front = ?, back = ?, front_hash = ?, content_hash = ?, version = version + 1 WHERE id = ?", front, back, frontHash, contentHash, existingID)
+		if err != nil {
+			return 0, err
+		}
+		return cardUpdated, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
+	}
+
+	cardID, _, err := writeCard(deckID, front, back, DuplicatesAllow)
+	if err != nil {
+		return 0, err
+	}
+	if err := tagCard(database.DB, cardID, tagID); err != nil {
+		return 0, err
+	}
+	return cardCreated, nil
+}
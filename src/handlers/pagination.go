@@ -0,0 +1,208 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+// listSort is a way a list can be ordered. Ties are broken by id, so every
+// row has a distinct position a cursor can point at.
+type listSort struct {
+	// Column in the list query to order by
+	column string
+	// Default direction, which order= can flip
+	desc bool
+	// How a cursor's value is turned back into a query parameter
+	parse func(string) (any, error)
+	// How a row's value is put in a cursor
+	format func(any) string
+}
+
+var (
+	sortByTime = listSort{
+		desc: true,
+		parse: func(s string) (any, error) {
+			return time.Parse(time.RFC3339Nano, s)
+		},
+		format: func(v any) string {
+			return v.(time.Time).UTC().Format(time.RFC3339Nano)
+		},
+	}
+	sortByInt = listSort{
+		desc: true,
+		parse: func(s string) (any, error) {
+			return strconv.Atoi(s)
+		},
+		format: func(v any) string {
+			return strconv.Itoa(v.(int))
+		},
+	}
+	sortByString = listSort{
+		parse: func(s string) (any, error) {
+			return s, nil
+		},
+		format: func(v any) string {
+			return v.(string)
+		},
+	}
+)
+
+func sortOn(column string, base listSort) listSort {
+	base.column = column
+	return base
+}
+
+func ascending(sort listSort) listSort {
+	sort.desc = false
+	return sort
+}
+
+// Sorts accepted by deck lists, keyed by the sort= value
+var deckSorts = map[string]listSort{
+	"updated":    sortOn("updated_at", sortByTime),
+	"created":    sortOn("created_at", sortByTime),
+	"name":       sortOn("name", sortByString),
+	"card_count": sortOn("card_count", sortByInt),
+}
+
+// Sorts accepted by card lists. Cards are oldest first by default, as before.
+var cardSorts = map[string]listSort{
+	"created": ascending(sortOn("created_at", sortByTime)),
+	"updated": sortOn("updated_at", sortByTime),
+}
+
+var errInvalidListParams = errors.New("invalid list parameters")
+
+// listPage describes which page of a list a request asked for
+type listPage struct {
+	// paginated is false when no list parameters were sent, in which case
+	// the whole list is returned as it always was
+	paginated bool
+	limit     int
+	sortName  string
+	sort      listSort
+	desc      bool
+	after     *listCursor
+}
+
+// listCursor points just past the last row of the previous page
+type listCursor struct {
+	Sort  string `json:"s"`
+	Desc  bool   `json:"d"`
+	Value string `json:"v"`
+	ID    int    `json:"id"`
+}
+
+// parseListPage reads limit, cursor, sort and order from the query string
+func parseListPage(r *http.Request, sorts map[string]listSort, defaultSort string) (listPage, error) {
+	query := r.URL.Query()
+	page := listPage{limit: defaultPageSize, sortName: defaultSort}
+	for _, param := range []string{"limit", "cursor", "sort", "order"} {
+		if query.Has(param) {
+			page.paginated = true
+		}
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			return page, errInvalidListParams
+		}
+		page.limit = min(n, maxPageSize)
+	}
+
+	if name := query.Get("sort"); name != "" {
+		page.sortName = name
+	}
+	sort, ok := sorts[page.sortName]
+	if !ok {
+		return page, errInvalidListParams
+	}
+	page.sort = sort
+	page.desc = sort.desc
+
+	switch query.Get("order") {
+	case "":
+	case "asc":
+		page.desc = false
+	case "desc":
+		page.desc = true
+	default:
+		return page, errInvalidListParams
+	}
+
+	if raw := query.Get("cursor"); raw != "" {
+		data, err := base64.RawURLEncoding.DecodeString(raw)
+		if err != nil {
+			return page, errInvalidListParams
+		}
+		var cursor listCursor
+		if err := json.Unmarshal(data, &cursor); err != nil {
+			return page, errInvalidListParams
+		}
+		// A cursor only makes sense for the order it was made for
+		if cursor.Sort != page.sortName || cursor.Desc != page.desc {
+			return page, errInvalidListParams
+		}
+		page.after = &cursor
+	}
+
+	return page, nil
+}
+
+// clause returns the WHERE condition (or "TRUE") and ORDER BY ... LIMIT for
+// a page of a query whose rows have page.sort.column and id
+func (page listPage) clause() (string, string, []any, error) {
+	op, dir := ">", "ASC"
+	if page.desc {
+		op, dir = "<", "DESC"
+	}
+	col := page.sort.column
+
+	where := "TRUE"
+	var args []any
+	if page.after != nil {
+		value, err := page.sort.parse(page.after.Value)
+		if err != nil {
+			return "", "", nil, errInvalidListParams
+		}
+		where = "(" + col + " " + op + " ? OR (" + col + " = ? AND id " + op + " ?))"
+		args = append(args, value, value, page.after.ID)
+	}
+
+	// One extra row shows whether there's another page
+	order := "ORDER BY " + col + " " + dir + ", id " + dir + " LIMIT " + strconv.Itoa(page.limit+1)
+	return where, order, args, nil
+}
+
+// nextCursor returns the cursor for the page after one ending with a row,
+// given that row's sort value and ID
+func (page listPage) nextCursor(value any, id int) string {
+	data, _ := json.Marshal(listCursor{Sort: page.sortName, Desc: page.desc, Value: page.sort.format(value), ID: id})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// setNextPage advertises the next page in a Link header and X-Next-Cursor.
+// The link is relative, carrying over the request's other list parameters.
+func setNextPage(w http.ResponseWriter, r *http.Request, cursor string) {
+	query := url.Values{}
+	for _, param := range []string{"limit", "sort", "order"} {
+		if value := r.URL.Query().Get(param); value != "" {
+			query.Set(param, value)
+		}
+	}
+	query.Set("cursor", cursor)
+
+	w.Header().Set("Link", `<?`+query.Encode()+`>; rel="next"`)
+	w.Header().Set("X-Next-Cursor", cursor)
+}
@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+
+	"quizzler/database"
+	"quizzler/mailer"
+	"quizzler/models"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ForgotPassword emails a password reset link. It responds the same way
+// whether or not the address belongs to an account.
+func ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var req models.EmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	if req.Email == "" {
+		http.Error(w, `{"error": "Email is required"}`, http.StatusBadRequest)
+		return
+	}
+
+	var userID int
+	var email string
+	err := database.DB.QueryRow("SELECT id, email FROM users WHERE email = ? AND active = 1", req.Email).Scan(&userID, &email)
+	if err == nil {
+		token, err := createUserToken(userID, tokenPasswordReset, "", passwordResetTTL)
+		if err != nil {
+			slog.Error("Failed to create password reset token", "error", err)
+		} else {
+			mailer.SendAsync(mailer.Message{
+				To:      email,
+				Subject: "Reset your Quizzler password",
+				Body: fmt.Sprintf("Someone asked to reset the password for your Quizzler account.\n\n"+
+					"Open this link within an hour to choose a new password:\n%s/reset-password?token=%s\n\n"+
+					"If this wasn't you, you can ignore this email.\n",
+					mailer.AppURL(), url.QueryEscape(token)),
+			})
+		}
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(`{"message": "If that address has an account, a reset link has been sent"}`))
+}
+
+// ResetPassword sets a new password using a token from ForgotPassword and signs out all sessions
+func ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var req models.ResetPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	if req.Token == "" || req.Password == "" {
+		http.Error(w, `{"error": "Token and password are required"}`, http.StatusBadRequest)
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, `{"error": "Failed to hash password"}`, http.StatusInternalServerError)
+		return
+	}
+
+	userID, _, err := consumeUserToken(req.Token, tokenPasswordReset)
+	if err != nil {
+		http.Error(w, `{"error": "Invalid or expired reset token"}`, http.StatusBadRequest)
+		return
+	}
+
+	// Receiving the email proves ownership of the address
+	_, err = database.DB.Exec("UPDATE users SET password = ?, email_verified_at = COALESCE(email_verified_at, NOW()) WHERE id = ?", string(hashedPassword), userID)
+	if err != nil {
+		http.Error(w, `{"error": "Failed to update password"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := revokeUserSessions(userID, ""); err != nil {
+		slog.Error("Failed to revoke sessions after password reset", "user_id", userID, "error", err)
+	}
+	// A reset usually means the account may be compromised, so API tokens go too
+	database.DB.Exec("UPDATE api_tokens SET revoked_at = NOW() WHERE user_id = ? AND revoked_at IS NULL", userID)
+
+	// Proving ownership of the email lifts any lockout
+	var email string
+	database.DB.QueryRow("SELECT email FROM users WHERE id = ?", userID).Scan(&email)
+	if email != "" && clearLoginFailures(email) {
+		recordAuditEvent(r, userID, auditLoginUnlocked, "password reset")
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
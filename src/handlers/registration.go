@@ -0,0 +1,260 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"quizzler/database"
+	"quizzler/middleware"
+	"quizzler/models"
+)
+
+// Registration modes, set with REGISTRATION_MODE
+const (
+	RegistrationOpen    = "open"
+	RegistrationClosed  = "closed"
+	RegistrationInvite  = "invite"
+	RegistrationDomains = "domains"
+)
+
+const maxInviteUses = 10000
+
+// registrationError is a reason registration was refused, safe to show to the user
+type registrationError struct {
+	message string
+}
+
+func (e *registrationError) Error() string {
+	return e.message
+}
+
+var (
+	errRegistrationClosed = &registrationError{"Registration is closed"}
+	errInviteRequired     = &registrationError{"An invite code is required to register"}
+	errInvalidInvite      = &registrationError{"Invalid or expired invite code"}
+)
+
+// registrationMode returns the configured mode. Unknown values close
+// registration rather than leaving it open by accident.
+func registrationMode() string {
+	mode := os.Getenv("REGISTRATION_MODE")
+	switch mode {
+	case "":
+		return RegistrationOpen
+	case RegistrationOpen, RegistrationClosed, RegistrationInvite, RegistrationDomains:
+		return mode
+	}
+	slog.Warn("Unknown REGISTRATION_MODE, registration is closed", "mode", mode)
+	return RegistrationClosed
+}
+
+// registrationDomains returns the email domains allowed in domains mode, from REGISTRATION_DOMAINS
+func registrationDomains() []string {
+	var domains []string
+	for _, domain := range strings.Split(os.Getenv("REGISTRATION_DOMAINS"), ",") {
+		if domain = strings.ToLower(strings.TrimSpace(domain)); domain != "" {
+			domains = append(domains, strings.TrimPrefix(domain, "@"))
+		}
+	}
+	return domains
+}
+
+func emailDomainAllowed(email string) bool {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+	return slices.Contains(registrationDomains(), strings.ToLower(email[at+1:]))
+}
+
+// checkRegistration decides whether an email address may sign up, and
+// whether an invite code has to be redeemed for it. The first account can
+// always be created so a closed instance can still be set up.
+func checkRegistration(email, inviteCode string) (bool, error) {
+	var userCount int
+	database.DB.QueryRow("SELECT COUNT(*) FROM users").Scan(&userCount)
+	if userCount == 0 {
+		return false, nil
+	}
+
+	switch registrationMode() {
+	case RegistrationOpen:
+		return false, nil
+	case RegistrationInvite:
+		if inviteCode == "" {
+			return false, errInviteRequired
+		}
+		return true, nil
+	case RegistrationDomains:
+		if emailDomainAllowed(email) {
+			return false, nil
+		}
+		// An invite lets someone outside the allowed domains in
+		if inviteCode != "" {
+			return true, nil
+		}
+		return false, &registrationError{"Registration is limited to " + strings.Join(registrationDomains(), ", ") + " email addresses"}
+	}
+	return false, errRegistrationClosed
+}
+
+// redeemInvite uses up one use of an invite code, returning its ID
+func redeemInvite(db execer, code string) (int, error) {
+	result, err := db.Exec(`
+		UPDATE invites SET uses = uses + 1, id = LAST_INSERT_ID(id)
+		WHERE code_hash = ? AND revoked_at IS NULL AND uses < max_uses AND (expires_at IS NULL OR expires_at > NOW())
+	`, middleware.HashToken(normalizeInviteCode(code)))
+	if err != nil {
+		return 0, err
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return 0, errInvalidInvite
+	}
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+// newInviteCode returns a random code like ABCD-EFGH-JKLM-NPQR
+func newInviteCode() (string, error) {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	raw := base32.StdEncoding.EncodeToString(b)
+	return raw[0:4] + "-" + raw[4:8] + "-" + raw[8:12] + "-" + raw[12:16], nil
+}
+
+func normalizeInviteCode(code string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// GetRegistrationConfig tells the frontend how registration works on this instance
+func GetRegistrationConfig(w http.ResponseWriter, r *http.Request) {
+	resp := models.RegistrationConfigResponse{Mode: registrationMode()}
+	if resp.Mode == RegistrationDomains {
+		resp.Domains = registrationDomains()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// AdminGetInvites lists invite codes that haven't been revoked
+func AdminGetInvites(w http.ResponseWriter, r *http.Request) {
+	rows, err := database.DB.Query(`
+		SELECT id, note, max_uses, uses, expires_at, created_at
+		FROM invites
+		WHERE revoked_at IS NULL
+		ORDER BY created_at DESC
+	`)
+	if err != nil {
+		http.Error(w, `{"error": "Failed to fetch invites"}`, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	invites := []models.Invite{}
+	for rows.Next() {
+		var invite models.Invite
+		if err := rows.Scan(&invite.ID, &invite.Note, &invite.MaxUses, &invite.Uses, &invite.ExpiresAt, &invite.CreatedAt); err != nil {
+			continue
+		}
+		invites = append(invites, invite)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(invites)
+}
+
+// AdminCreateInvite creates an invite code. The code is only returned here; we just keep its hash.
+func AdminCreateInvite(w http.ResponseWriter, r *http.Request) {
+	var req models.CreateInviteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	if req.MaxUses == 0 {
+		req.MaxUses = 1
+	}
+	if req.MaxUses < 0 || req.MaxUses > maxInviteUses {
+		http.Error(w, `{"error": "max_uses must be between 1 and 10000"}`, http.StatusBadRequest)
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		http.Error(w, `{"error": "Expiry must be in the future"}`, http.StatusBadRequest)
+		return
+	}
+	req.Note = truncate(strings.TrimSpace(req.Note), 255)
+
+	code, err := newInviteCode()
+	if err != nil {
+		http.Error(w, `{"error": "Failed to generate invite"}`, http.StatusInternalServerError)
+		return
+	}
+
+	result, err := database.DB.Exec("INSERT INTO invites (code_hash, note, max_uses, expires_at, created_by) VALUES (?, ?, ?, ?, ?)",
+		middleware.HashToken(normalizeInviteCode(code)), req.Note, req.MaxUses, req.ExpiresAt, middleware.GetUserID(r))
+	if err != nil {
+		http.Error(w, `{"error": "Failed to create invite"}`, http.StatusInternalServerError)
+		return
+	}
+
+	id, _ := result.LastInsertId()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(models.CreateInviteResponse{
+		Invite: models.Invite{
+			ID:        int(id),
+			Note:      req.Note,
+			MaxUses:   req.MaxUses,
+			ExpiresAt: req.ExpiresAt,
+			CreatedAt: time.Now(),
+		},
+		Code: code,
+	})
+}
+
+// AdminDeleteInvite revokes an invite code
+func AdminDeleteInvite(w http.ResponseWriter, r *http.Request) {
+	inviteID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, `{"error": "Invalid invite ID"}`, http.StatusBadRequest)
+		return
+	}
+
+	result, err := database.DB.Exec("UPDATE invites SET revoked_at = NOW() WHERE id = ? AND revoked_at IS NULL", inviteID)
+	if err != nil {
+		http.Error(w, `{"error": "Failed to revoke invite"}`, http.StatusInternalServerError)
+		return
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		http.Error(w, `{"error": "Invite not found"}`, http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeRegistrationError writes the reason registration was refused
+func writeRegistrationError(w http.ResponseWriter, err error) {
+	var regErr *registrationError
+	if errors.As(err, &regErr) {
+		message, _ := json.Marshal(regErr.message)
+		http.Error(w, `{"error": `+string(message)+`}`, http.StatusForbidden)
+		return
+	}
+	http.Error(w, `{"error": "Failed to register"}`, http.StatusInternalServerError)
+}
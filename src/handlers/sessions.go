@@ -0,0 +1,190 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"quizzler/database"
+	"quizzler/middleware"
+	"quizzler/models"
+)
+
+// startSession records a new login and returns its refresh token family ID
+func startSession(r *http.Request, userID int, device string) (string, error) {
+	familyID, err := middleware.NewOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	userAgent := r.UserAgent()
+	if device == "" {
+		device = describeDevice(userAgent)
+	}
+
+	_, err = database.DB.Exec("INSERT INTO sessions (user_id, family_id, device, user_agent, ip) VALUES (?, ?, ?, ?, ?)",
+		userID, familyID, truncate(device, 255), truncate(userAgent, 512), middleware.ClientIP(r))
+	if err != nil {
+		return "", err
+	}
+	return familyID, nil
+}
+
+// revokeSession revokes a login session along with its refresh tokens
+func revokeSession(familyID string) error {
+	if _, err := database.DB.Exec("UPDATE sessions SET revoked_at = NOW() WHERE family_id = ? AND revoked_at IS NULL", familyID); err != nil {
+		return err
+	}
+	if _, err := database.DB.Exec("UPDATE refresh_tokens SET revoked_at = NOW() WHERE family_id = ? AND revoked_at IS NULL", familyID); err != nil {
+		return err
+	}
+	middleware.MarkSessionRevoked(familyID)
+	return nil
+}
+
+// revokeUserSessions revokes all of a user's sessions, optionally keeping one
+func revokeUserSessions(userID int, exceptFamilyID string) error {
+	rows, err := database.DB.Query("SELECT family_id FROM sessions WHERE user_id = ? AND revoked_at IS NULL AND family_id != ?", userID, exceptFamilyID)
+	if err != nil {
+		return err
+	}
+	var families []string
+	for rows.Next() {
+		var familyID string
+		if err := rows.Scan(&familyID); err == nil {
+			families = append(families, familyID)
+		}
+	}
+	rows.Close()
+
+	for _, familyID := range families {
+		if err := revokeSession(familyID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// describeDevice makes a rough "Browser on OS" label from a user agent
+func describeDevice(userAgent string) string {
+	browser := ""
+	switch {
+	case strings.Contains(userAgent, "Edg/"):
+		browser = "Edge"
+	case strings.Contains(userAgent, "Firefox/"):
+		browser = "Firefox"
+	case strings.Contains(userAgent, "Chrome/"):
+		browser = "Chrome"
+	case strings.Contains(userAgent, "Safari/"):
+		browser = "Safari"
+	case strings.Contains(userAgent, "curl/"):
+		browser = "curl"
+	}
+
+	os := ""
+	switch {
+	case strings.Contains(userAgent, "iPhone"), strings.Contains(userAgent, "iPad"):
+		os = "iOS"
+	case strings.Contains(userAgent, "Android"):
+		os = "Android"
+	case strings.Contains(userAgent, "Windows"):
+		os = "Windows"
+	case strings.Contains(userAgent, "Mac OS X"):
+		os = "macOS"
+	case strings.Contains(userAgent, "Linux"):
+		os = "Linux"
+	}
+
+	switch {
+	case browser != "" && os != "":
+		return browser + " on " + os
+	case browser != "":
+		return browser
+	case os != "":
+		return os
+	}
+	return "Unknown device"
+}
+
+// truncate shortens s to at most n characters, which is how MySQL measures
+// VARCHAR lengths. Invalid UTF-8, which MySQL would reject, is replaced.
+func truncate(s string, n int) string {
+	s = strings.ToValidUTF8(s, "\uFFFD")
+	count := 0
+	for i := range s {
+		if count == n {
+			return s[:i]
+		}
+		count++
+	}
+	return s
+}
+
+// GetSessions lists the user's active logins
+func GetSessions(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.GetUserID(r)
+	currentFamilyID := middleware.GetFamilyID(r)
+
+	rows, err := database.DB.Query(`
+		SELECT id, family_id, device, user_agent, ip, created_at, last_seen_at
+		FROM sessions
+		WHERE user_id = ? AND revoked_at IS NULL
+		ORDER BY last_seen_at DESC
+	`, userID)
+	if err != nil {
+		http.Error(w, `{"error": "Failed to fetch sessions"}`, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	sessions := []models.Session{}
+	for rows.Next() {
+		var session models.Session
+		var familyID string
+		if err := rows.Scan(&session.ID, &familyID, &session.Device, &session.UserAgent, &session.IP, &session.CreatedAt, &session.LastSeenAt); err != nil {
+			continue
+		}
+		session.Current = familyID == currentFamilyID
+		sessions = append(sessions, session)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessions)
+}
+
+// DeleteSession revokes one of the user's logins
+func DeleteSession(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.GetUserID(r)
+	sessionID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, `{"error": "Invalid session ID"}`, http.StatusBadRequest)
+		return
+	}
+
+	var familyID string
+	err = database.DB.QueryRow("SELECT family_id FROM sessions WHERE id = ? AND user_id = ? AND revoked_at IS NULL", sessionID, userID).Scan(&familyID)
+	if err != nil {
+		http.Error(w, `{"error": "Session not found"}`, http.StatusNotFound)
+		return
+	}
+
+	if err := revokeSession(familyID); err != nil {
+		http.Error(w, `{"error": "Failed to revoke session"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeleteAllSessions logs the user out everywhere, including the current session
+func DeleteAllSessions(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.GetUserID(r)
+
+	if err := revokeUserSessions(userID, ""); err != nil {
+		http.Error(w, `{"error": "Failed to revoke sessions"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,270 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"quizzler/database"
+	"quizzler/mailer"
+	"quizzler/middleware"
+	"quizzler/models"
+	"quizzler/oidc"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const ssoStateCookie = "quizzler_sso"
+
+var (
+	errSSOEmailUnverified = errors.New("your identity provider did not confirm your email address")
+	errSSOSignupDisabled  = errors.New("no account exists for this email address")
+)
+
+// ssoSignupAllowed reports whether single sign-on may create new accounts, from OIDC_ALLOW_SIGNUP
+func ssoSignupAllowed() bool {
+	return os.Getenv("OIDC_ALLOW_SIGNUP") != "false"
+}
+
+// GetSSOConfig tells the frontend whether single sign-on is available
+func GetSSOConfig(w http.ResponseWriter, r *http.Request) {
+	resp := models.SSOConfigResponse{}
+	if p := oidc.Current(); p != nil {
+		resp.Enabled = true
+		resp.Name = p.Config.Name
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// SSOLogin starts a single sign-on login by redirecting to the identity provider
+func SSOLogin(w http.ResponseWriter, r *http.Request) {
+	p := oidc.Current()
+	if p == nil {
+		http.Error(w, `{"error": "Single sign-on is not configured"}`, http.StatusNotFound)
+		return
+	}
+
+	state, err := middleware.NewOpaqueToken()
+	if err != nil {
+		http.Error(w, `{"error": "Failed to start login"}`, http.StatusInternalServerError)
+		return
+	}
+	nonce, err := middleware.NewOpaqueToken()
+	if err != nil {
+		http.Error(w, `{"error": "Failed to start login"}`, http.StatusInternalServerError)
+		return
+	}
+	verifier, err := oidc.NewVerifier()
+	if err != nil {
+		http.Error(w, `{"error": "Failed to start login"}`, http.StatusInternalServerError)
+		return
+	}
+
+	authURL, err := p.AuthCodeURL(r.Context(), state, nonce, verifier)
+	if err != nil {
+		slog.Error("Failed to reach identity provider", "error", err)
+		http.Error(w, `{"error": "Identity provider is unavailable"}`, http.StatusBadGateway)
+		return
+	}
+
+	cookie, err := middleware.GenerateSSOState(state, nonce, verifier)
+	if err != nil {
+		http.Error(w, `{"error": "Failed to start login"}`, http.StatusInternalServerError)
+		return
+	}
+	setSSOStateCookie(w, cookie, int(middleware.SSOStateTTL.Seconds()))
+
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// SSOCallback handles the identity provider's redirect back, signs the user
+// in and hands the frontend a short-lived code to exchange for a session
+func SSOCallback(w http.ResponseWriter, r *http.Request) {
+	p := oidc.Current()
+	if p == nil {
+		http.Error(w, `{"error": "Single sign-on is not configured"}`, http.StatusNotFound)
+		return
+	}
+
+	cookie, err := r.Cookie(ssoStateCookie)
+	setSSOStateCookie(w, "", -1)
+	if err != nil {
+		redirectSSOError(w, r, "Your sign-in attempt expired, please try again")
+		return
+	}
+
+	state, nonce, verifier, err := middleware.ParseSSOState(cookie.Value)
+	if err != nil || r.URL.Query().Get("state") != state {
+		redirectSSOError(w, r, "Your sign-in attempt expired, please try again")
+		return
+	}
+
+	if idpError := r.URL.Query().Get("error"); idpError != "" {
+		slog.Warn("Identity provider returned an error", "error", idpError, "description", r.URL.Query().Get("error_description"))
+		redirectSSOError(w, r, "Sign-in was cancelled or refused by your identity provider")
+		return
+	}
+
+	code := r.URL.Query().Get("code")
+	if code == "" {
+		redirectSSOError(w, r, "Sign-in failed, please try again")
+		return
+	}
+
+	claims, err := p.Exchange(r.Context(), code, verifier, nonce)
+	if err != nil {
+		slog.Error("Single sign-on failed", "error", err)
+		redirectSSOError(w, r, "Sign-in failed, please try again")
+		return
+	}
+
+	userID, err := findOrLinkSSOUser(claims)
+	if err != nil {
+		var regErr *registrationError
+		if errors.Is(err, errSSOEmailUnverified) || errors.Is(err, errSSOSignupDisabled) || errors.As(err, &regErr) {
+			redirectSSOError(w, r, err.Error())
+			return
+		}
+		slog.Error("Failed to link single sign-on identity", "error", err)
+		redirectSSOError(w, r, "Sign-in failed, please try again")
+		return
+	}
+
+	token, err := createUserToken(userID, tokenSSOLogin, "", ssoLoginTTL)
+	if err != nil {
+		redirectSSOError(w, r, "Sign-in failed, please try again")
+		return
+	}
+
+	// The fragment keeps the code out of server and proxy logs
+	http.Redirect(w, r, mailer.AppURL()+"/#sso="+url.QueryEscape(token), http.StatusFound)
+}
+
+// SSOExchange swaps the code from SSOCallback for a session, or a two-factor challenge
+func SSOExchange(w http.ResponseWriter, r *http.Request) {
+	var req models.SSOExchangeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	if req.Token == "" {
+		http.Error(w, `{"error": "Token is required"}`, http.StatusBadRequest)
+		return
+	}
+
+	userID, _, err := consumeUserToken(req.Token, tokenSSOLogin)
+	if err != nil {
+		http.Error(w, `{"error": "Invalid or expired sign-in code"}`, http.StatusUnauthorized)
+		return
+	}
+
+	user, err := getUser(userID)
+	if err != nil {
+		http.Error(w, `{"error": "Invalid or expired sign-in code"}`, http.StatusUnauthorized)
+		return
+	}
+
+	respondWithLogin(w, r, user, req.Device)
+}
+
+// findOrLinkSSOUser returns the account for an identity provider subject.
+// Unknown subjects are linked to the account with the same email, which must
+// be verified by the provider, or get a new account if signup is allowed.
+func findOrLinkSSOUser(claims *oidc.Claims) (int, error) {
+	var userID int
+	err := database.DB.QueryRow("SELECT user_id FROM user_identities WHERE issuer = ? AND subject = ?", claims.Issuer, claims.Subject).Scan(&userID)
+	if err == nil {
+		database.DB.Exec("UPDATE user_identities SET email = ?, last_login_at = NOW() WHERE issuer = ? AND subject = ?", claims.Email, claims.Issuer, claims.Subject)
+		return userID, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, err
+	}
+
+	if claims.Email == "" || !claims.EmailVerified {
+		return 0, errSSOEmailUnverified
+	}
+	email := strings.TrimSpace(claims.Email)
+
+	err = database.DB.QueryRow("SELECT id FROM users WHERE email = ?", email).Scan(&userID)
+	switch {
+	case err == nil:
+		// The provider vouches for the address, so the account's email is verified too
+		database.DB.Exec("UPDATE users SET email_verified_at = NOW() WHERE id = ? AND email_verified_at IS NULL", userID)
+	case err == sql.ErrNoRows:
+		if !ssoSignupAllowed() {
+			return 0, errSSOSignupDisabled
+		}
+		// There's nowhere to enter an invite code, so invite-only instances can't sign up through SSO
+		if needInvite, err := checkRegistration(email, ""); err != nil || needInvite {
+			if err == nil {
+				err = errInviteRequired
+			}
+			return 0, err
+		}
+		userID, err = createSSOUser(email)
+		if err != nil {
+			return 0, err
+		}
+	default:
+		return 0, err
+	}
+
+	_, err = database.DB.Exec("INSERT INTO user_identities (user_id, issuer, subject, email, last_login_at) VALUES (?, ?, ?, ?, NOW())",
+		userID, claims.Issuer, claims.Subject, email)
+	if err != nil {
+		return 0, err
+	}
+
+	slog.Info("Linked single sign-on identity", "user_id", userID, "issuer", claims.Issuer)
+	return userID, nil
+}
+
+// createSSOUser creates a verified account with an unguessable password. The
+// user can set a real one through the password reset flow if they want.
+func createSSOUser(email string) (int, error) {
+	password, err := middleware.NewOpaqueToken()
+	if err != nil {
+		return 0, err
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return 0, err
+	}
+
+	// Make the first user admin, same as Register
+	var userCount int
+	database.DB.QueryRow("SELECT COUNT(*) FROM users").Scan(&userCount)
+
+	result, err := database.DB.Exec("INSERT INTO users (email, password, admin, email_verified_at) VALUES (?, ?, ?, NOW())", email, string(hashedPassword), userCount == 0)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+func setSSOStateCookie(w http.ResponseWriter, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     ssoStateCookie,
+		Value:    value,
+		Path:     "/api/auth/oidc",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(mailer.AppURL(), "https://"),
+		// Lax is needed for the cookie to come back on the provider's top-level redirect
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func redirectSSOError(w http.ResponseWriter, r *http.Request, message string) {
+	http.Redirect(w, r, mailer.AppURL()+"/#sso_error="+url.QueryEscape(message), http.StatusFound)
+}
@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"database/sql"
+
+	"quizzler/database"
+	"quizzler/models"
+)
+
+// execer is satisfied by both *sql.DB and *sql.Tx
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// ensureTag returns the ID of the user's tag with the given name, creating it if needed
+func ensureTag(db execer, userID int, name string) (int, error) {
+	result, err := db.Exec("INSERT INTO tags (user_id, name) VALUES (?, ?) ON DUPLICATE KEY UPDATE id = LAST_INSERT_ID(id)", userID, name)
+	if err != nil {
+		return 0, err
+	}
+	tagID, err := result.LastInsertId()
+	return int(tagID), err
+}
+
+func tagCard(db execer, cardID, tagID int) error {
+	_, err := db.Exec("INSERT IGNORE INTO card_tags (card_id, tag_id) VALUES (?, ?)", cardID, tagID)
+	return err
+}
+
+// attachTags fills in the tag names of cards belonging to a deck
+func attachTags(deckID int, cards []models.Card) {
+	if len(cards) == 0 {
+		return
+	}
+
+	rows, err := database.DB.Query(`
+		SELECT ct.card_id, t.name
+		FROM card_tags ct
+		JOIN tags t ON ct.tag_id = t.id
+		JOIN cards c ON ct.card_id = c.id
+		WHERE c.deck_id = ?
+		ORDER BY t.name
+	`, deckID)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	tags := map[int][]string{}
+	for rows.Next() {
+		var cardID int
+		var name string
+		if err := rows.Scan(&cardID, &name); err != nil {
+			continue
+		}
+		tags[cardID] = append(tags[cardID], name)
+	}
+
+	for i := range cards {
+		cards[i].Tags = tags[cards[i].ID]
+	}
+}
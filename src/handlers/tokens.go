@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"quizzler/database"
+	"quizzler/middleware"
+	"quizzler/models"
+)
+
+// issueTokens creates an access token and a refresh token for a user's login session
+func issueTokens(userID int, familyID string) (models.TokenResponse, error) {
+	refreshToken, err := middleware.NewOpaqueToken()
+	if err != nil {
+		return models.TokenResponse{}, err
+	}
+
+	_, err = database.DB.Exec("INSERT INTO refresh_tokens (user_id, family_id, token_hash, expires_at) VALUES (?, ?, ?, ?)",
+		userID, familyID, middleware.HashToken(refreshToken), time.Now().Add(middleware.RefreshTokenTTL()))
+	if err != nil {
+		return models.TokenResponse{}, err
+	}
+
+	accessToken, err := middleware.GenerateToken(userID, familyID)
+	if err != nil {
+		return models.TokenResponse{}, err
+	}
+
+	return models.TokenResponse{
+		Token:        accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(middleware.AccessTokenTTL().Seconds()),
+	}, nil
+}
+
+// RefreshToken exchanges a refresh token for a new access and refresh token.
+// Each refresh token can only be used once; presenting one that was already
+// used means it has leaked, so the whole session is revoked.
+func RefreshToken(w http.ResponseWriter, r *http.Request) {
+	var req models.RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	if req.RefreshToken == "" {
+		http.Error(w, `{"error": "Refresh token is required"}`, http.StatusBadRequest)
+		return
+	}
+
+	var id, userID int
+	var familyID string
+	var expiresAt time.Time
+	var usedAt, revokedAt sql.NullTime
+	err := database.DB.QueryRow("SELECT id, user_id, family_id, expires_at, used_at, revoked_at FROM refresh_tokens WHERE token_hash = ?",
+		middleware.HashToken(req.RefreshToken)).Scan(&id, &userID, &familyID, &expiresAt, &usedAt, &revokedAt)
+	if err != nil {
+		http.Error(w, `{"error": "Invalid refresh token"}`, http.StatusUnauthorized)
+		return
+	}
+
+	if revokedAt.Valid || time.Now().After(expiresAt) {
+		http.Error(w, `{"error": "Invalid refresh token"}`, http.StatusUnauthorized)
+		return
+	}
+
+	if usedAt.Valid {
+		slog.Warn("Refresh token reuse detected, revoking family", "user_id", userID)
+		revokeSession(familyID)
+		http.Error(w, `{"error": "Invalid refresh token"}`, http.StatusUnauthorized)
+		return
+	}
+
+	// Guard against two concurrent refreshes with the same token
+	result, err := database.DB.Exec("UPDATE refresh_tokens SET used_at = NOW() WHERE id = ? AND used_at IS NULL", id)
+	if err != nil {
+		http.Error(w, `{"error": "Failed to refresh token"}`, http.StatusInternalServerError)
+		return
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		slog.Warn("Refresh token reuse detected, revoking family", "user_id", userID)
+		revokeSession(familyID)
+		http.Error(w, `{"error": "Invalid refresh token"}`, http.StatusUnauthorized)
+		return
+	}
+
+	database.DB.Exec("UPDATE sessions SET last_seen_at = NOW(), ip = ? WHERE family_id = ?", middleware.ClientIP(r), familyID)
+
+	tokens, err := issueTokens(userID, familyID)
+	if err != nil {
+		http.Error(w, `{"error": "Failed to generate token"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// Logout revokes the current session
+func Logout(w http.ResponseWriter, r *http.Request) {
+	if err := revokeSession(middleware.GetFamilyID(r)); err != nil {
+		http.Error(w, `{"error": "Failed to log out"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,342 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"quizzler/database"
+	"quizzler/middleware"
+	"quizzler/models"
+	"quizzler/totp"
+
+	"github.com/skip2/go-qrcode"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	totpIssuer        = "Quizzler"
+	recoveryCodeCount = 10
+	// 10 random bytes give 16 base32 characters, 80 bits per code
+	recoveryCodeBytes = 10
+)
+
+// newRecoveryCodes replaces the user's recovery codes, returning the new plaintext codes
+func newRecoveryCodes(userID int) ([]string, error) {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, recoveryCodeBytes)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		raw := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+		codes[i] = raw[:4] + "-" + raw[4:8] + "-" + raw[8:12] + "-" + raw[12:]
+
+		hash, err := bcrypt.GenerateFromPassword([]byte(raw), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec("INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)", userID, string(hash)); err != nil {
+			return nil, err
+		}
+	}
+
+	return codes, tx.Commit()
+}
+
+// verifySecondFactor accepts either a current TOTP code or an unused recovery
+// code. TOTP time steps and recovery codes can each only be used once.
+func verifySecondFactor(userID int, code string) bool {
+	var secret sql.NullString
+	var lastStep int64
+	err := database.DB.QueryRow("SELECT totp_secret, totp_last_step FROM users WHERE id = ? AND totp_enabled = 1", userID).Scan(&secret, &lastStep)
+	if err != nil || !secret.Valid {
+		return false
+	}
+
+	if step, ok := totp.Validate(secret.String, code, time.Now()); ok {
+		if step <= lastStep {
+			return false
+		}
+		result, err := database.DB.Exec("UPDATE users SET totp_last_step = ? WHERE id = ? AND totp_last_step < ?", step, userID, step)
+		if err != nil {
+			return false
+		}
+		rowsAffected, _ := result.RowsAffected()
+		return rowsAffected == 1
+	}
+
+	return useRecoveryCode(userID, code)
+}
+
+// useRecoveryCode marks a matching unused recovery code as used. Codes are
+// bcrypt hashed, so each unused code is compared in turn.
+func useRecoveryCode(userID int, code string) bool {
+	normalized := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	if len(normalized) != base32.StdEncoding.EncodedLen(recoveryCodeBytes) {
+		return false
+	}
+
+	rows, err := database.DB.Query("SELECT id, code_hash FROM recovery_codes WHERE user_id = ? AND used_at IS NULL", userID)
+	if err != nil {
+		return false
+	}
+	defer rows.Close()
+
+	matchID := 0
+	for rows.Next() {
+		var id int
+		var hash string
+		if err := rows.Scan(&id, &hash); err != nil {
+			return false
+		}
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(normalized)) == nil {
+			matchID = id
+			break
+		}
+	}
+	if matchID == 0 || rows.Err() != nil {
+		return false
+	}
+	rows.Close()
+
+	result, err := database.DB.Exec("UPDATE recovery_codes SET used_at = NOW() WHERE id = ? AND used_at IS NULL", matchID)
+	if err != nil {
+		return false
+	}
+	rowsAffected, _ := result.RowsAffected()
+	return rowsAffected == 1
+}
+
+// SetupTwoFactor generates a new TOTP secret for the user to add to their
+// authenticator app, requiring the password. It isn't enforced until confirmed
+// with EnableTwoFactor.
+func SetupTwoFactor(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.GetUserID(r)
+
+	var req models.TwoFactorSetupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	if req.CurrentPassword == "" {
+		http.Error(w, `{"error": "Current password is required"}`, http.StatusBadRequest)
+		return
+	}
+
+	if !checkCurrentPassword(w, userID, req.CurrentPassword) {
+		return
+	}
+
+	var email string
+	var enabled bool
+	if err := database.DB.QueryRow("SELECT email, totp_enabled FROM users WHERE id = ?", userID).Scan(&email, &enabled); err != nil {
+		http.Error(w, `{"error": "User not found"}`, http.StatusNotFound)
+		return
+	}
+	if enabled {
+		http.Error(w, `{"error": "Two-factor authentication is already enabled"}`, http.StatusConflict)
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		http.Error(w, `{"error": "Failed to generate secret"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := database.DB.Exec("UPDATE users SET totp_secret = ? WHERE id = ?", secret, userID); err != nil {
+		http.Error(w, `{"error": "Failed to save secret"}`, http.StatusInternalServerError)
+		return
+	}
+
+	uri := totp.URI(totpIssuer, email, secret)
+	png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+	if err != nil {
+		http.Error(w, `{"error": "Failed to generate QR code"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.TwoFactorSetupResponse{
+		Secret: secret,
+		URI:    uri,
+		QRCode: "data:image/png;base64," + base64.StdEncoding.EncodeToString(png),
+	})
+}
+
+// EnableTwoFactor confirms the pending secret with the password and a code, and
+// returns the recovery codes
+func EnableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.GetUserID(r)
+
+	var req models.EnableTwoFactorRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	if req.CurrentPassword == "" || req.Code == "" {
+		http.Error(w, `{"error": "Current password and code are required"}`, http.StatusBadRequest)
+		return
+	}
+
+	if !checkCurrentPassword(w, userID, req.CurrentPassword) {
+		return
+	}
+
+	var secret sql.NullString
+	var enabled bool
+	if err := database.DB.QueryRow("SELECT totp_secret, totp_enabled FROM users WHERE id = ?", userID).Scan(&secret, &enabled); err != nil {
+		http.Error(w, `{"error": "User not found"}`, http.StatusNotFound)
+		return
+	}
+	if enabled {
+		http.Error(w, `{"error": "Two-factor authentication is already enabled"}`, http.StatusConflict)
+		return
+	}
+	if !secret.Valid {
+		http.Error(w, `{"error": "Two-factor setup has not been started"}`, http.StatusBadRequest)
+		return
+	}
+
+	step, ok := totp.Validate(secret.String, req.Code, time.Now())
+	if !ok {
+		http.Error(w, `{"error": "Invalid code"}`, http.StatusBadRequest)
+		return
+	}
+
+	if _, err := database.DB.Exec("UPDATE users SET totp_enabled = 1, totp_last_step = ? WHERE id = ?", step, userID); err != nil {
+		http.Error(w, `{"error": "Failed to enable two-factor authentication"}`, http.StatusInternalServerError)
+		return
+	}
+
+	codes, err := newRecoveryCodes(userID)
+	if err != nil {
+		http.Error(w, `{"error": "Failed to generate recovery codes"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// DisableTwoFactor turns off two-factor authentication, requiring the password and a second factor
+func DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.GetUserID(r)
+
+	var req models.DisableTwoFactorRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	if req.CurrentPassword == "" || req.Code == "" {
+		http.Error(w, `{"error": "Current password and code are required"}`, http.StatusBadRequest)
+		return
+	}
+
+	if !checkCurrentPassword(w, userID, req.CurrentPassword) {
+		return
+	}
+
+	if !verifySecondFactor(userID, req.Code) {
+		http.Error(w, `{"error": "Invalid code"}`, http.StatusBadRequest)
+		return
+	}
+
+	if _, err := database.DB.Exec("UPDATE users SET totp_secret = NULL, totp_enabled = 0, totp_last_step = 0 WHERE id = ?", userID); err != nil {
+		http.Error(w, `{"error": "Failed to disable two-factor authentication"}`, http.StatusInternalServerError)
+		return
+	}
+	database.DB.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RegenerateRecoveryCodes replaces the user's recovery codes after checking a second factor
+func RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.GetUserID(r)
+
+	var req models.TwoFactorCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	if !verifySecondFactor(userID, req.Code) {
+		http.Error(w, `{"error": "Invalid code"}`, http.StatusBadRequest)
+		return
+	}
+
+	codes, err := newRecoveryCodes(userID)
+	if err != nil {
+		http.Error(w, `{"error": "Failed to generate recovery codes"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// LoginTwoFactor completes a login started by Login, exchanging the challenge
+// token and a TOTP or recovery code for a session
+func LoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var req models.LoginTwoFactorRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	if req.ChallengeToken == "" || req.Code == "" {
+		http.Error(w, `{"error": "Challenge token and code are required"}`, http.StatusBadRequest)
+		return
+	}
+
+	userID, device, err := middleware.ParseChallengeToken(req.ChallengeToken)
+	if err != nil {
+		http.Error(w, `{"error": "Invalid or expired challenge"}`, http.StatusUnauthorized)
+		return
+	}
+
+	user, err := getUser(userID)
+	if err != nil {
+		http.Error(w, `{"error": "Invalid or expired challenge"}`, http.StatusUnauthorized)
+		return
+	}
+
+	// Wrong codes count towards the same lockout as wrong passwords
+	if remaining := loginLockedFor(user.Email); remaining > 0 {
+		writeLockedOut(w, remaining)
+		return
+	}
+
+	if !verifySecondFactor(userID, req.Code) {
+		recordLoginFailure(r, user.Email, user.ID)
+		http.Error(w, `{"error": "Invalid code"}`, http.StatusUnauthorized)
+		return
+	}
+	clearLoginFailures(user.Email)
+	if !user.Active {
+		http.Error(w, `{"error": "This account has been deactivated"}`, http.StatusForbidden)
+		return
+	}
+
+	respondWithSession(w, r, user, device)
+}
@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"errors"
+	"time"
+
+	"quizzler/database"
+	"quizzler/middleware"
+)
+
+// Purposes of single-use tokens sent to users by email or handed to the frontend
+const (
+	tokenPasswordReset = "password_reset"
+	tokenVerifyEmail   = "verify_email"
+	tokenChangeEmail   = "change_email"
+	tokenSSOLogin      = "sso_login"
+)
+
+const (
+	passwordResetTTL = time.Hour
+	verifyEmailTTL   = 48 * time.Hour
+	changeEmailTTL   = 24 * time.Hour
+	ssoLoginTTL      = 2 * time.Minute
+)
+
+var errInvalidUserToken = errors.New("invalid or expired token")
+
+// createUserToken issues a single-use token for a purpose, invalidating any
+// earlier unused tokens for the same purpose. Only the hash is stored.
+func createUserToken(userID int, purpose, data string, ttl time.Duration) (string, error) {
+	token, err := middleware.NewOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = database.DB.Exec("UPDATE user_tokens SET used_at = NOW() WHERE user_id = ? AND purpose = ? AND used_at IS NULL", userID, purpose)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = database.DB.Exec("INSERT INTO user_tokens (user_id, purpose, token_hash, data, expires_at) VALUES (?, ?, ?, ?, ?)",
+		userID, purpose, middleware.HashToken(token), data, time.Now().Add(ttl))
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// consumeUserToken marks a token as used and returns the user and data it was issued with
+func consumeUserToken(token, purpose string) (int, string, error) {
+	var id, userID int
+	var data string
+	var expiresAt time.Time
+	err := database.DB.QueryRow("SELECT id, user_id, data, expires_at FROM user_tokens WHERE token_hash = ? AND purpose = ? AND used_at IS NULL",
+		middleware.HashToken(token), purpose).Scan(&id, &userID, &data, &expiresAt)
+	if err != nil || time.Now().After(expiresAt) {
+		return 0, "", errInvalidUserToken
+	}
+
+	result, err := database.DB.Exec("UPDATE user_tokens SET used_at = NOW() WHERE id = ? AND used_at IS NULL", id)
+	if err != nil {
+		return 0, "", err
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return 0, "", errInvalidUserToken
+	}
+	return userID, data, nil
+}
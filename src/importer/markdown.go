@@ -0,0 +1,235 @@
+package importer
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Card is a flashcard extracted from notes
+type Card struct {
+	Front string
+	Back  string
+}
+
+// Section is a group of cards found under the same heading path in a file
+type Section struct {
+	Deck  string
+	File  string
+	Cards []Card
+}
+
+var (
+	headingPattern    = regexp.MustCompile(`^(#{1,6})\s+(.+?)\s*#*\s*$`)
+	listMarkerPattern = regexp.MustCompile(`^\s*(?:[-*+]|\d+[.)])\s+`)
+	inlineSeparator   = regexp.MustCompile(`\s:::?\s`)
+)
+
+const (
+	// Limits on Markdown decompressed from a ZIP, per file and in total
+	maxZipEntrySize = 16 << 20
+	maxZipTotalSize = 64 << 20
+)
+
+// ErrArchiveTooLarge is returned when a ZIP decompresses to more than the limits allow
+var ErrArchiveTooLarge = errors.New("archive is too large once decompressed")
+
+// IsZip reports whether data looks like a ZIP archive
+func IsZip(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("PK\x03\x04"))
+}
+
+// MarkdownZip parses every Markdown file in a ZIP archive
+func MarkdownZip(data []byte) ([]Section, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+
+	var sections []Section
+	var total int64
+	for _, f := range zr.File {
+		ext := strings.ToLower(path.Ext(f.Name))
+		if f.FileInfo().IsDir() || (ext != ".md" && ext != ".markdown") {
+			continue
+		}
+		if f.UncompressedSize64 > maxZipEntrySize {
+			return nil, ErrArchiveTooLarge
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		// The header's size can lie, so read one byte past the limit to catch it
+		content, err := io.ReadAll(io.LimitReader(rc, maxZipEntrySize+1))
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		total += int64(len(content))
+		if len(content) > maxZipEntrySize || total > maxZipTotalSize {
+			return nil, ErrArchiveTooLarge
+		}
+
+		sections = append(sections, Markdown(f.Name, string(content))...)
+	}
+	return sections, nil
+}
+
+// Markdown extracts cards from a Markdown note. It understands
+//
+//	Question :: Answer       inline cards
+//	Question ::: Answer      inline cards that are also added reversed
+//	Question lines
+//	?
+//	Answer lines             multi-line cards, ended by a blank line or heading
+//
+// Headings name the deck the following cards go into, with nested headings
+// joined as "Parent / Child". Cards before the first heading go into a deck
+// named after the file.
+func Markdown(filename, content string) []Section {
+	defaultDeck := strings.TrimSuffix(path.Base(filename), path.Ext(filename))
+
+	var sections []Section
+	var headings []string
+	current := Section{Deck: defaultDeck, File: filename}
+
+	flush := func() {
+		if len(current.Cards) > 0 {
+			sections = append(sections, current)
+		}
+	}
+
+	lines := strings.Split(strings.ReplaceAll(content, "\r\n", "\n"), "\n")
+	lines = skipFrontMatter(lines)
+
+	var block []string
+	inFence := false
+
+	// endBlock turns the paragraph collected so far into cards
+	endBlock := func() {
+		current.Cards = append(current.Cards, parseBlock(block)...)
+		block = nil
+	}
+
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			inFence = !inFence
+			block = append(block, line)
+			continue
+		}
+		if inFence {
+			block = append(block, line)
+			continue
+		}
+
+		if m := headingPattern.FindStringSubmatch(trimmed); m != nil {
+			endBlock()
+			flush()
+
+			level := len(m[1])
+			if len(headings) >= level {
+				headings = headings[:level-1]
+			}
+			for len(headings) < level-1 {
+				headings = append(headings, "")
+			}
+			headings = append(headings, m[2])
+
+			current = Section{Deck: joinHeadings(headings, defaultDeck), File: filename}
+			continue
+		}
+
+		if trimmed == "" {
+			endBlock()
+			continue
+		}
+		block = append(block, line)
+	}
+	endBlock()
+	flush()
+
+	return sections
+}
+
+// parseBlock extracts cards from a paragraph of consecutive non-blank lines.
+// Lines inside code fences are kept as card content but never treated as separators.
+func parseBlock(block []string) []Card {
+	inFence := false
+	fenced := make([]bool, len(block))
+	for i, line := range block {
+		trimmed := strings.TrimSpace(line)
+		isFence := strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~")
+		fenced[i] = inFence || isFence
+		if isFence {
+			inFence = !inFence
+		}
+	}
+
+	for i, line := range block {
+		if !fenced[i] && strings.TrimSpace(line) == "?" {
+			front := strings.TrimSpace(strings.Join(block[:i], "\n"))
+			back := strings.TrimSpace(strings.Join(block[i+1:], "\n"))
+			if front == "" || back == "" {
+				return nil
+			}
+			return []Card{{Front: front, Back: back}}
+		}
+	}
+
+	var cards []Card
+	for i, line := range block {
+		if fenced[i] {
+			continue
+		}
+
+		loc := inlineSeparator.FindStringIndex(line)
+		if loc == nil {
+			continue
+		}
+		front := strings.TrimSpace(listMarkerPattern.ReplaceAllString(line[:loc[0]], ""))
+		back := strings.TrimSpace(line[loc[1]:])
+		if front == "" || back == "" {
+			continue
+		}
+
+		cards = append(cards, Card{Front: front, Back: back})
+		if strings.TrimSpace(line[loc[0]:loc[1]]) == ":::" {
+			cards = append(cards, Card{Front: back, Back: front})
+		}
+	}
+	return cards
+}
+
+// skipFrontMatter drops a leading YAML front matter block
+func skipFrontMatter(lines []string) []string {
+	if len(lines) == 0 || strings.TrimSpace(lines[0]) != "---" {
+		return lines
+	}
+	for i := 1; i < len(lines); i++ {
+		if strings.TrimSpace(lines[i]) == "---" {
+			return lines[i+1:]
+		}
+	}
+	return lines
+}
+
+func joinHeadings(headings []string, fallback string) string {
+	var parts []string
+	for _, h := range headings {
+		if h != "" {
+			parts = append(parts, h)
+		}
+	}
+	if len(parts) == 0 {
+		return fallback
+	}
+	return strings.Join(parts, " / ")
+}
@@ -0,0 +1,34 @@
+package mailer
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// LogMailer is a development mailer that appends messages to a file, or to the log when no path is set
+type LogMailer struct {
+	Path string
+	mu   sync.Mutex
+}
+
+func (m *LogMailer) Send(msg Message) error {
+	if m.Path == "" {
+		slog.Info("Email", "to", msg.To, "subject", msg.Subject, "body", msg.Body)
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, err := os.OpenFile(m.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintf(f, "Date: %s\nTo: %s\nSubject: %s\n\n%s\n\n----\n\n", time.Now().Format(time.RFC1123Z), msg.To, msg.Subject, msg.Body)
+	return err
+}
@@ -0,0 +1,78 @@
+package mailer
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// Message is a plain text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers email
+type Mailer interface {
+	Send(msg Message) error
+}
+
+var current Mailer = &LogMailer{}
+
+// Init selects the mailer from MAIL_DRIVER: "smtp", or "log" (the default)
+// which writes messages to the log or to MAIL_FILE for development
+func Init() error {
+	switch driver := getEnv("MAIL_DRIVER", "log"); driver {
+	case "smtp":
+		m, err := NewSMTPMailer(
+			getEnv("SMTP_HOST", ""),
+			getEnv("SMTP_PORT", "587"),
+			getEnv("SMTP_USERNAME", ""),
+			getEnv("SMTP_PASSWORD", ""),
+			getEnv("MAIL_FROM", ""),
+		)
+		if err != nil {
+			return err
+		}
+		current = m
+	case "log":
+		current = &LogMailer{Path: getEnv("MAIL_FILE", "")}
+	default:
+		return fmt.Errorf("unknown MAIL_DRIVER %q", driver)
+	}
+
+	slog.Info("Mailer configured", "driver", getEnv("MAIL_DRIVER", "log"))
+	return nil
+}
+
+// SetMailer replaces the mailer used by Send
+func SetMailer(m Mailer) {
+	current = m
+}
+
+// Send delivers a message using the configured mailer
+func Send(msg Message) error {
+	return current.Send(msg)
+}
+
+// SendAsync delivers a message in the background, logging any failure
+func SendAsync(msg Message) {
+	go func() {
+		if err := Send(msg); err != nil {
+			slog.Error("Failed to send email", "subject", msg.Subject, "error", err)
+		}
+	}()
+}
+
+// AppURL is the public URL of the frontend used to build links in emails
+func AppURL() string {
+	return getEnv("APP_URL", "http://127.0.0.1:5172")
+}
+
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
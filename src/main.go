@@ -10,7 +10,9 @@ import (
 	"quizzler/cache"
 	"quizzler/database"
 	"quizzler/handlers"
+	"quizzler/mailer"
 	"quizzler/middleware"
+	"quizzler/oidc"
 )
 
 func main() {
@@ -35,35 +37,95 @@ func main() {
 		slog.Error("Failed to run migrations", "error", err)
 		os.Exit(1)
 	}
+	if err := handlers.BackfillCardHashes(); err != nil {
+		slog.Error("Failed to backfill card hashes", "error", err)
+		os.Exit(1)
+	}
+	middleware.StartIdempotencySweeper()
 
 	// Initialize cache
 	if err := cache.Init(); err != nil {
-		slog.Warn("Failed to connect to Redis, caching disabled", "error", err)
-	} else {
-		defer cache.Close()
+		slog.Warn("Failed to connect to Redis, using the in-memory cache until it's available", "error", err)
+	}
+	defer cache.Close()
+
+	// Initialize mailer
+	if err := mailer.Init(); err != nil {
+		slog.Warn("Failed to configure mailer, emails will be logged", "error", err)
+	}
+
+	// Initialize single sign-on
+	if err := oidc.Init(); err != nil {
+		slog.Error("Failed to configure single sign-on", "error", err)
+		os.Exit(1)
 	}
 
 	// API routes
 	api := http.NewServeMux()
+	api.Handle("GET /register", http.HandlerFunc(handlers.GetRegistrationConfig))
 	api.Handle("POST /register", middleware.RateLimit(3)(http.HandlerFunc(handlers.Register)))
 	api.Handle("POST /login", middleware.RateLimit(10)(http.HandlerFunc(handlers.Login)))
+	api.Handle("POST /login/2fa", middleware.RateLimit(10)(http.HandlerFunc(handlers.LoginTwoFactor)))
+	api.Handle("GET /auth/oidc", http.HandlerFunc(handlers.GetSSOConfig))
+	api.Handle("GET /auth/oidc/login", middleware.RateLimit(10)(http.HandlerFunc(handlers.SSOLogin)))
+	api.Handle("GET /auth/oidc/callback", middleware.RateLimit(10)(http.HandlerFunc(handlers.SSOCallback)))
+	api.Handle("POST /auth/oidc/exchange", middleware.RateLimit(10)(http.HandlerFunc(handlers.SSOExchange)))
+	api.Handle("POST /token/refresh", middleware.RateLimit(30)(http.HandlerFunc(handlers.RefreshToken)))
+	api.Handle("POST /logout", middleware.AuthMiddleware(http.HandlerFunc(handlers.Logout)))
+	api.Handle("POST /password/forgot", middleware.RateLimit(3)(http.HandlerFunc(handlers.ForgotPassword)))
+	api.Handle("POST /password/reset", middleware.RateLimit(10)(http.HandlerFunc(handlers.ResetPassword)))
+	api.Handle("POST /email/verify", middleware.RateLimit(10)(http.HandlerFunc(handlers.VerifyEmail)))
+	api.Handle("POST /email/verify/resend", middleware.RateLimit(3)(http.HandlerFunc(handlers.ResendVerification)))
+	api.Handle("POST /email/change/confirm", middleware.RateLimit(10)(http.HandlerFunc(handlers.ConfirmEmailChange)))
 	api.Handle("GET /public-decks", middleware.RateLimit(15)(http.HandlerFunc(handlers.GetPublicDecksBrowse)))
 	api.Handle("GET /public-decks/{id}", middleware.RateLimit(30)(http.HandlerFunc(handlers.GetPublicDeck)))
 	api.Handle("GET /public-decks/{id}/cards", middleware.RateLimit(30)(http.HandlerFunc(handlers.GetPublicDeckCards)))
 
-	api.Handle("GET /decks", middleware.AuthMiddleware(http.HandlerFunc(handlers.GetDecks)))
-	api.Handle("GET /decks/public", middleware.AuthMiddleware(http.HandlerFunc(handlers.GetPublicDecks)))
-	api.Handle("POST /decks", middleware.AuthMiddleware(http.HandlerFunc(handlers.CreateDeck)))
-	api.Handle("GET /decks/{id}", middleware.AuthMiddleware(http.HandlerFunc(handlers.GetDeck)))
+	api.Handle("GET /decks", middleware.AllowToken(middleware.ScopeDecksRead)(middleware.AuthMiddleware(http.HandlerFunc(handlers.GetDecks))))
+	api.Handle("GET /decks/public", middleware.AllowToken(middleware.ScopeDecksRead)(middleware.AuthMiddleware(http.HandlerFunc(handlers.GetPublicDecks))))
+	api.Handle("POST /decks", middleware.AuthMiddleware(middleware.Idempotent(http.HandlerFunc(handlers.CreateDeck))))
+	api.Handle("POST /decks/import/notes", middleware.AllowToken(middleware.ScopeImport)(middleware.AuthMiddleware(middleware.RateLimit(10)(http.HandlerFunc(handlers.ImportNotes)))))
+	api.Handle("GET /decks/{id}", middleware.AllowToken(middleware.ScopeDecksRead)(middleware.AuthMiddleware(http.HandlerFunc(handlers.GetDeck))))
 	api.Handle("PUT /decks/{id}", middleware.AuthMiddleware(http.HandlerFunc(handlers.UpdateDeck)))
 	api.Handle("DELETE /decks/{id}", middleware.AuthMiddleware(http.HandlerFunc(handlers.DeleteDeck)))
-
-	api.Handle("GET /decks/{deckId}/cards", middleware.AuthMiddleware(http.HandlerFunc(handlers.GetCards)))
-	api.Handle("POST /decks/{deckId}/cards", middleware.AuthMiddleware(http.HandlerFunc(handlers.CreateCard)))
-	api.Handle("POST /decks/{deckId}/cards/import", middleware.AuthMiddleware(http.HandlerFunc(handlers.ImportCards)))
-	api.Handle("GET /cards/{id}", middleware.AuthMiddleware(http.HandlerFunc(handlers.GetCard)))
-	api.Handle("PUT /cards/{id}", middleware.AuthMiddleware(http.HandlerFunc(handlers.UpdateCard)))
-	api.Handle("DELETE /cards/{id}", middleware.AuthMiddleware(http.HandlerFunc(handlers.DeleteCard)))
+	api.Handle("GET /decks/{id}/duplicates", middleware.AllowToken(middleware.ScopeDecksRead)(middleware.AuthMiddleware(http.HandlerFunc(handlers.GetDuplicates))))
+	api.Handle("GET /decks/{id}/export/markdown", middleware.AllowToken(middleware.ScopeDecksRead)(middleware.AuthMiddleware(http.HandlerFunc(handlers.ExportDeckMarkdown))))
+	api.Handle("GET /decks/{id}/export/pdf", middleware.AllowToken(middleware.ScopeDecksRead)(middleware.AuthMiddleware(middleware.RateLimit(10)(http.HandlerFunc(handlers.ExportDeckPDF)))))
+	api.Handle("GET /decks/{id}/export/gift", middleware.AllowToken(middleware.ScopeDecksRead)(middleware.AuthMiddleware(http.HandlerFunc(handlers.ExportDeckGIFT))))
+	api.Handle("GET /decks/{id}/export/qti", middleware.AllowToken(middleware.ScopeDecksRead)(middleware.AuthMiddleware(middleware.RateLimit(10)(http.HandlerFunc(handlers.ExportDeckQTI)))))
+
+	api.Handle("GET /decks/{deckId}/cards", middleware.AllowToken(middleware.ScopeDecksRead)(middleware.AuthMiddleware(http.HandlerFunc(handlers.GetCards))))
+	api.Handle("POST /decks/{deckId}/cards", middleware.AllowToken(middleware.ScopeCardsWrite)(middleware.AuthMiddleware(middleware.Idempotent(http.HandlerFunc(handlers.CreateCard)))))
+	api.Handle("POST /decks/{deckId}/cards/import", middleware.AllowToken(middleware.ScopeImport)(middleware.AuthMiddleware(middleware.RateLimit(10)(middleware.Idempotent(http.HandlerFunc(handlers.ImportCards))))))
+	api.Handle("GET /cards/{id}", middleware.AllowToken(middleware.ScopeDecksRead)(middleware.AuthMiddleware(http.HandlerFunc(handlers.GetCard))))
+	api.Handle("PUT /cards/{id}", middleware.AllowToken(middleware.ScopeCardsWrite)(middleware.AuthMiddleware(http.HandlerFunc(handlers.UpdateCard))))
+	api.Handle("DELETE /cards/{id}", middleware.AllowToken(middleware.ScopeCardsWrite)(middleware.AuthMiddleware(http.HandlerFunc(handlers.DeleteCard))))
+
+	api.Handle("GET /me", middleware.AuthMiddleware(http.HandlerFunc(handlers.GetMe)))
+	api.Handle("PUT /me/password", middleware.AuthMiddleware(middleware.RateLimit(5)(http.HandlerFunc(handlers.ChangePassword))))
+	api.Handle("PUT /me/email", middleware.AuthMiddleware(middleware.RateLimit(5)(http.HandlerFunc(handlers.ChangeEmail))))
+	api.Handle("POST /me/2fa/setup", middleware.AuthMiddleware(middleware.RateLimit(5)(http.HandlerFunc(handlers.SetupTwoFactor))))
+	api.Handle("POST /me/2fa/enable", middleware.AuthMiddleware(http.HandlerFunc(handlers.EnableTwoFactor)))
+	api.Handle("POST /me/2fa/disable", middleware.AuthMiddleware(http.HandlerFunc(handlers.DisableTwoFactor)))
+	api.Handle("POST /me/2fa/recovery-codes", middleware.AuthMiddleware(http.HandlerFunc(handlers.RegenerateRecoveryCodes)))
+	api.Handle("GET /me/export", middleware.AuthMiddleware(middleware.RateLimit(5)(http.HandlerFunc(handlers.ExportAccount))))
+	api.Handle("POST /me/import", middleware.AuthMiddleware(middleware.RateLimit(5)(http.HandlerFunc(handlers.ImportAccount))))
+	api.Handle("GET /me/tokens", middleware.AuthMiddleware(http.HandlerFunc(handlers.GetAPITokens)))
+	api.Handle("POST /me/tokens", middleware.AuthMiddleware(http.HandlerFunc(handlers.CreateAPIToken)))
+	api.Handle("DELETE /me/tokens/{id}", middleware.AuthMiddleware(http.HandlerFunc(handlers.DeleteAPIToken)))
+	api.Handle("GET /me/sessions", middleware.AuthMiddleware(http.HandlerFunc(handlers.GetSessions)))
+	api.Handle("DELETE /me/sessions", middleware.AuthMiddleware(http.HandlerFunc(handlers.DeleteAllSessions)))
+	api.Handle("DELETE /me/sessions/{id}", middleware.AuthMiddleware(http.HandlerFunc(handlers.DeleteSession)))
+
+	api.Handle("GET /admin/users", middleware.AuthMiddleware(middleware.AdminMiddleware(http.HandlerFunc(handlers.AdminGetUsers))))
+	api.Handle("GET /admin/users/{id}", middleware.AuthMiddleware(middleware.AdminMiddleware(http.HandlerFunc(handlers.AdminGetUser))))
+	api.Handle("PUT /admin/users/{id}", middleware.AuthMiddleware(middleware.AdminMiddleware(http.HandlerFunc(handlers.AdminUpdateUser))))
+	api.Handle("DELETE /admin/users/{id}/lockout", middleware.AuthMiddleware(middleware.AdminMiddleware(http.HandlerFunc(handlers.AdminUnlockUser))))
+	api.Handle("GET /admin/audit", middleware.AuthMiddleware(middleware.AdminMiddleware(http.HandlerFunc(handlers.AdminGetAuditEvents))))
+	api.Handle("GET /admin/invites", middleware.AuthMiddleware(middleware.AdminMiddleware(http.HandlerFunc(handlers.AdminGetInvites))))
+	api.Handle("POST /admin/invites", middleware.AuthMiddleware(middleware.AdminMiddleware(http.HandlerFunc(handlers.AdminCreateInvite))))
+	api.Handle("DELETE /admin/invites/{id}", middleware.AuthMiddleware(middleware.AdminMiddleware(http.HandlerFunc(handlers.AdminDeleteInvite))))
+	api.Handle("GET /admin/stats", middleware.AuthMiddleware(middleware.AdminMiddleware(http.HandlerFunc(handlers.AdminGetStats))))
 
 	// Main router
 	mux := http.NewServeMux()
@@ -0,0 +1,22 @@
+package middleware
+
+import (
+	"net/http"
+
+	"quizzler/database"
+)
+
+// AdminMiddleware only lets active admins through. It must run after AuthMiddleware.
+func AdminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Checked on every request so demoting an admin takes effect straight away
+		var admin, active bool
+		err := database.DB.QueryRow("SELECT admin, active FROM users WHERE id = ?", GetUserID(r)).Scan(&admin, &active)
+		if err != nil || !admin || !active {
+			http.Error(w, `{"error": "Admin access required"}`, http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,78 @@
+package middleware
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"quizzler/database"
+)
+
+// APITokenPrefix marks personal access tokens so they can be told apart from JWTs
+const APITokenPrefix = "qz_"
+
+// Scopes a personal access token can be granted
+const (
+	ScopeDecksRead  = "decks:read"
+	ScopeCardsWrite = "cards:write"
+	ScopeImport     = "import"
+)
+
+// Scopes lists every valid scope
+var Scopes = []string{ScopeDecksRead, ScopeCardsWrite, ScopeImport}
+
+const (
+	requiredScopeKey contextKey = "requiredScope"
+	APITokenIDKey    contextKey = "apiTokenID"
+)
+
+var errInvalidAPIToken = errors.New("invalid API token")
+
+// AllowToken lets personal access tokens with a scope use a route. It wraps
+// AuthMiddleware; routes without it only accept login sessions.
+func AllowToken(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), requiredScopeKey, scope)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// GetAPITokenID returns the personal access token the request was made with, or 0 for a login session
+func GetAPITokenID(r *http.Request) int {
+	id, _ := r.Context().Value(APITokenIDKey).(int)
+	return id
+}
+
+// lookupAPIToken returns the token ID, user and scopes of a valid personal
+// access token, recording when it was used
+func lookupAPIToken(token string) (int, int, []string, error) {
+	var id, userID int
+	var scopes string
+	var expiresAt sql.NullTime
+	err := database.DB.QueryRow(`
+		SELECT t.id, t.user_id, t.scopes, t.expires_at
+		FROM api_tokens t
+		JOIN users u ON u.id = t.user_id
+		WHERE t.token_hash = ? AND t.revoked_at IS NULL AND u.active = 1
+	`, HashToken(token)).Scan(&id, &userID, &scopes, &expiresAt)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			slog.Error("Failed to look up API token", "error", err)
+		}
+		return 0, 0, nil, errInvalidAPIToken
+	}
+	if expiresAt.Valid && time.Now().After(expiresAt.Time) {
+		return 0, 0, nil, errInvalidAPIToken
+	}
+
+	// Only write last_used_at once a minute for busy tokens
+	database.DB.Exec("UPDATE api_tokens SET last_used_at = NOW() WHERE id = ? AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL 1 MINUTE)", id)
+
+	return id, userID, strings.Split(scopes, ","), nil
+}
@@ -2,17 +2,27 @@ package middleware
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"log/slog"
 	"net/http"
 	"os"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
 type contextKey string
 
-const UserIDKey contextKey = "userID"
+const (
+	UserIDKey   contextKey = "userID"
+	FamilyIDKey contextKey = "familyID"
+)
 
 func getJWTSecret() []byte {
 	secret := os.Getenv("JWT_SECRET")
@@ -23,7 +33,41 @@ func getJWTSecret() []byte {
 	return []byte(secret)
 }
 
+func getJWTIssuer() string {
+	if issuer := os.Getenv("JWT_ISSUER"); issuer != "" {
+		return issuer
+	}
+	return "quizzler"
+}
+
+// AccessTokenTTL is how long access tokens are valid for, from ACCESS_TOKEN_TTL
+func AccessTokenTTL() time.Duration {
+	return getDurationEnv("ACCESS_TOKEN_TTL", 15*time.Minute)
+}
+
+// RefreshTokenTTL is how long refresh tokens are valid for, from REFRESH_TOKEN_TTL
+func RefreshTokenTTL() time.Duration {
+	return getDurationEnv("REFRESH_TOKEN_TTL", 30*24*time.Hour)
+}
+
+func getDurationEnv(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		slog.Warn("Invalid duration, using default", "key", key, "value", value, "default", defaultValue)
+		return defaultValue
+	}
+	return d
+}
+
+// AuthMiddleware authenticates a login session or personal access token, and
+// rate limits each user with the default authenticated policy
 func AuthMiddleware(next http.Handler) http.Handler {
+	next = RateLimitWith(authRateLimitPolicy())(next)
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		authHeader := r.Header.Get("Authorization")
 		if authHeader == "" {
@@ -37,9 +81,33 @@ func AuthMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
+		if strings.HasPrefix(tokenString, APITokenPrefix) {
+			tokenID, userID, scopes, err := lookupAPIToken(tokenString)
+			if err != nil {
+				http.Error(w, `{"error": "Invalid token"}`, http.StatusUnauthorized)
+				return
+			}
+
+			scope, _ := r.Context().Value(requiredScopeKey).(string)
+			if scope == "" || !slices.Contains(scopes, scope) {
+				http.Error(w, `{"error": "API token does not have access to this endpoint"}`, http.StatusForbidden)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), UserIDKey, userID)
+			ctx = context.WithValue(ctx, APITokenIDKey, tokenID)
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+
 		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
 			return getJWTSecret(), nil
-		})
+		},
+			jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+			jwt.WithIssuer(getJWTIssuer()),
+			jwt.WithExpirationRequired(),
+			jwt.WithIssuedAt(),
+		)
 
 		if err != nil || !token.Valid {
 			http.Error(w, `{"error": "Invalid token"}`, http.StatusUnauthorized)
@@ -52,8 +120,19 @@ func AuthMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
-		userID := int(claims["user_id"].(float64))
-		ctx := context.WithValue(r.Context(), UserIDKey, userID)
+		userIDClaim, ok := claims["user_id"].(float64)
+		if !ok {
+			http.Error(w, `{"error": "Invalid token claims"}`, http.StatusUnauthorized)
+			return
+		}
+		familyID, _ := claims["fid"].(string)
+		if !isSessionActive(familyID) {
+			http.Error(w, `{"error": "Session has been revoked"}`, http.StatusUnauthorized)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), UserIDKey, int(userIDClaim))
+		ctx = context.WithValue(ctx, FamilyIDKey, familyID)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
@@ -66,9 +145,141 @@ func GetUserID(r *http.Request) int {
 	return userID
 }
 
-func GenerateToken(userID int) (string, error) {
+// GetFamilyID returns the refresh token family the request's access token was issued for
+func GetFamilyID(r *http.Request) string {
+	familyID, _ := r.Context().Value(FamilyIDKey).(string)
+	return familyID
+}
+
+// GenerateToken issues a short-lived access token for a user, tied to a refresh token family
+func GenerateToken(userID int, familyID string) (string, error) {
+	jti, err := NewOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
 		"user_id": userID,
+		"fid":     familyID,
+		"iss":     getJWTIssuer(),
+		"iat":     now.Unix(),
+		"exp":     now.Add(AccessTokenTTL()).Unix(),
+		"jti":     jti,
 	})
 	return token.SignedString(getJWTSecret())
 }
+
+// ChallengeTokenTTL is how long a user has to complete the second login step
+const ChallengeTokenTTL = 5 * time.Minute
+
+// getChallengeSecret derives a separate signing key for two-factor challenge
+// tokens, so they can never be mistaken for access tokens
+func getChallengeSecret() []byte {
+	sum := sha256.Sum256(append(getJWTSecret(), []byte(":2fa-challenge")...))
+	return sum[:]
+}
+
+// GenerateChallengeToken issues a token proving the password step of a
+// two-factor login succeeded
+func GenerateChallengeToken(userID int, device string) (string, error) {
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"user_id": userID,
+		"device":  device,
+		"iss":     getJWTIssuer(),
+		"iat":     now.Unix(),
+		"exp":     now.Add(ChallengeTokenTTL).Unix(),
+	})
+	return token.SignedString(getChallengeSecret())
+}
+
+// ParseChallengeToken validates a challenge token, returning the user and device it was issued for
+func ParseChallengeToken(tokenString string) (int, string, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		return getChallengeSecret(), nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithIssuer(getJWTIssuer()),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil || !token.Valid {
+		return 0, "", errors.New("invalid challenge token")
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return 0, "", errors.New("invalid challenge token")
+	}
+	userID, ok := claims["user_id"].(float64)
+	if !ok {
+		return 0, "", errors.New("invalid challenge token")
+	}
+	device, _ := claims["device"].(string)
+	return int(userID), device, nil
+}
+
+// SSOStateTTL is how long a user has to complete a single sign-on login at their identity provider
+const SSOStateTTL = 10 * time.Minute
+
+// getSSOStateSecret derives the key signing single sign-on state cookies
+func getSSOStateSecret() []byte {
+	sum := sha256.Sum256(append(getJWTSecret(), []byte(":sso-state")...))
+	return sum[:]
+}
+
+// GenerateSSOState signs the state, nonce and PKCE verifier of a pending
+// single sign-on login so they can be kept in a cookie until the callback
+func GenerateSSOState(state, nonce, verifier string) (string, error) {
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"state":    state,
+		"nonce":    nonce,
+		"verifier": verifier,
+		"iss":      getJWTIssuer(),
+		"iat":      now.Unix(),
+		"exp":      now.Add(SSOStateTTL).Unix(),
+	})
+	return token.SignedString(getSSOStateSecret())
+}
+
+// ParseSSOState validates a state cookie, returning the state, nonce and verifier it holds
+func ParseSSOState(tokenString string) (string, string, string, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		return getSSOStateSecret(), nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithIssuer(getJWTIssuer()),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil || !token.Valid {
+		return "", "", "", errors.New("invalid sso state")
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return "", "", "", errors.New("invalid sso state")
+	}
+	state, _ := claims["state"].(string)
+	nonce, _ := claims["nonce"].(string)
+	verifier, _ := claims["verifier"].(string)
+	if state == "" || nonce == "" || verifier == "" {
+		return "", "", "", errors.New("invalid sso state")
+	}
+	return state, nonce, verifier, nil
+}
+
+// NewOpaqueToken returns a random URL-safe token
+func NewOpaqueToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashToken returns the SHA-256 hex digest of an opaque token, for storage
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
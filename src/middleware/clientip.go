@@ -0,0 +1,196 @@
+package middleware
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	trustedProxiesOnce sync.Once
+	trustedProxies     []netip.Prefix
+
+	proxyHeaderOnce sync.Once
+	proxyHeader     string
+)
+
+// getProxyHeader returns the forwarding header trusted proxies set, from
+// TRUSTED_PROXY_HEADER: X-Forwarded-For (the default), Forwarded or X-Real-IP.
+// Only that header is read, so a client can't slip an address past the proxy
+// in a header it doesn't overwrite.
+func getProxyHeader() string {
+	proxyHeaderOnce.Do(func() {
+		proxyHeader = "X-Forwarded-For"
+		value := strings.TrimSpace(os.Getenv("TRUSTED_PROXY_HEADER"))
+		switch {
+		case value == "" || strings.EqualFold(value, "X-Forwarded-For"):
+		case strings.EqualFold(value, "Forwarded"):
+			proxyHeader = "Forwarded"
+		case strings.EqualFold(value, "X-Real-IP"):
+			proxyHeader = "X-Real-IP"
+		default:
+			slog.Warn("Unknown TRUSTED_PROXY_HEADER, using X-Forwarded-For", "value", value)
+		}
+	})
+	return proxyHeader
+}
+
+// getTrustedProxies parses TRUSTED_PROXIES, a comma separated list of IPs and
+// CIDRs of reverse proxies whose forwarding headers we believe. Empty means
+// no proxy is trusted and the connection's address is always used.
+func getTrustedProxies() []netip.Prefix {
+	trustedProxiesOnce.Do(func() {
+		for _, entry := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+
+			var prefix netip.Prefix
+			var err error
+			if strings.Contains(entry, "/") {
+				prefix, err = netip.ParsePrefix(entry)
+			} else {
+				var addr netip.Addr
+				addr, err = netip.ParseAddr(entry)
+				prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+			}
+			if err != nil {
+				slog.Warn("Ignoring invalid trusted proxy", "value", entry)
+				continue
+			}
+			if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+				prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+			}
+			trustedProxies = append(trustedProxies, prefix.Masked())
+		}
+	})
+	return trustedProxies
+}
+
+func isTrustedProxy(addr netip.Addr) bool {
+	for _, prefix := range getTrustedProxies() {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP resolves the address of the client that made the request. The
+// forwarding header is only used when the connection comes from a trusted
+// proxy, and is read right to left, skipping trusted hops, so a client can't
+// pick its own address by sending a spoofed header.
+func ClientIP(r *http.Request) string {
+	remote, ok := parseHop(r.RemoteAddr)
+	if !ok {
+		return r.RemoteAddr
+	}
+	if !isTrustedProxy(remote) {
+		return remote.String()
+	}
+
+	var hops []string
+	switch getProxyHeader() {
+	case "Forwarded":
+		hops = forwardedFor(r.Header.Values("Forwarded"))
+	case "X-Real-IP":
+		// The proxy sets a single address, so anything else wasn't written by it
+		if values := r.Header.Values("X-Real-IP"); len(values) == 1 {
+			hops = values
+		}
+	default:
+		hops = forwardedHops(r.Header.Values("X-Forwarded-For"))
+	}
+	if len(hops) == 0 {
+		return remote.String()
+	}
+
+	client := remote
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, ok := parseHop(hops[i])
+		if !ok {
+			// An obfuscated or garbled hop; the last address we could read is as close as we get
+			break
+		}
+		client = addr
+		if !isTrustedProxy(addr) {
+			break
+		}
+	}
+	return client.String()
+}
+
+// forwardedHops splits X-Forwarded-For header lines into hops, oldest first
+func forwardedHops(values []string) []string {
+	var hops []string
+	for _, value := range values {
+		for _, hop := range strings.Split(value, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	return hops
+}
+
+// forwardedFor returns the for= parameters of RFC 7239 Forwarded header lines, oldest first
+func forwardedFor(values []string) []string {
+	var hops []string
+	for _, value := range values {
+		for _, element := range splitQuoted(value, ',') {
+			for _, pair := range splitQuoted(element, ';') {
+				key, val, found := strings.Cut(strings.TrimSpace(pair), "=")
+				if found && strings.EqualFold(strings.TrimSpace(key), "for") {
+					hops = append(hops, strings.Trim(strings.TrimSpace(val), `"`))
+				}
+			}
+		}
+	}
+	return hops
+}
+
+// splitQuoted splits s on sep, ignoring separators inside quoted strings
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	inQuotes := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && inQuotes:
+			i++
+		case s[i] == '"':
+			inQuotes = !inQuotes
+		case s[i] == sep && !inQuotes:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// parseHop parses an address that may have a port and IPv6 brackets,
+// like 192.0.2.1, 192.0.2.1:8080, [2001:db8::1]:443 or 2001:db8::1
+func parseHop(hop string) (netip.Addr, bool) {
+	hop = strings.TrimSpace(hop)
+	if hop == "" {
+		return netip.Addr{}, false
+	}
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		hop = host
+	}
+	hop = strings.TrimSuffix(strings.TrimPrefix(hop, "["), "]")
+	// Drop IPv6 zones, they mean nothing to anyone else
+	if i := strings.IndexByte(hop, '%'); i >= 0 {
+		hop = hop[:i]
+	}
+	addr, err := netip.ParseAddr(hop)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
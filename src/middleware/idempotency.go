@@ -0,0 +1,193 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"quizzler/database"
+)
+
+const (
+	// How long a key's response is kept for replaying
+	IdempotencyKeyTTL = 24 * time.Hour
+
+	// A request still unfinished after this is assumed to have died with its server
+	idempotencyAbandonedAfter = time.Minute
+
+	maxIdempotencyKeyLength = 255
+	// Request bodies are read in full to hash them, so they're capped
+	maxIdempotentRequest = 16 << 20
+	// Bodies bigger than this aren't worth keeping for a retry
+	maxIdempotentResponse = 1 << 20
+
+	// How often every user's expired keys are deleted, and how many at a time
+	idempotencySweepInterval = time.Hour
+	idempotencySweepBatch    = 1000
+)
+
+// Idempotent lets clients safely retry a POST by sending an Idempotency-Key
+// header. The first response for a key is stored and replayed for retries
+// with the same body; reusing the key for a different body is refused. It
+// must run after AuthMiddleware, since keys are per user.
+func Idempotent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			http.Error(w, `{"error": "Idempotency-Key is too long"}`, http.StatusBadRequest)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIdempotentRequest))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, `{"error": "Request body is too large"}`, http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		userID := GetUserID(r)
+		keyHash := HashToken(key)
+		requestHash := hashRequest(r, body)
+
+		// Prune the user's expired keys, and this key if its server died mid-request, so it can start over
+		database.DB.Exec(`
+			DELETE FROM idempotency_keys
+			WHERE user_id = ?
+				AND (created_at < NOW() - INTERVAL ? SECOND OR (key_hash = ? AND status_code IS NULL AND created_at < NOW() - INTERVAL ? SECOND))
+		`, userID, int(IdempotencyKeyTTL.Seconds()), keyHash, int(idempotencyAbandonedAfter.Seconds()))
+
+		result, err := database.DB.Exec("INSERT IGNORE INTO idempotency_keys (user_id, key_hash, request_hash) VALUES (?, ?, ?)", userID, keyHash, requestHash)
+		if err != nil {
+			slog.Error("Failed to record idempotency key", "error", err)
+			http.Error(w, `{"error": "Failed to process request"}`, http.StatusInternalServerError)
+			return
+		}
+		if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+			replayIdempotent(w, userID, keyHash, requestHash)
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		completed := false
+		defer func() {
+			if !completed {
+				// The handler panicked, let the client retry
+				database.DB.Exec("DELETE FROM idempotency_keys WHERE user_id = ? AND key_hash = ?", userID, keyHash)
+			}
+		}()
+
+		next.ServeHTTP(rec, r)
+		completed = true
+
+		// Server errors and oversized responses aren't stored, so a retry runs again
+		if rec.status >= 500 || rec.body.Len() > maxIdempotentResponse {
+			database.DB.Exec("DELETE FROM idempotency_keys WHERE user_id = ? AND key_hash = ?", userID, keyHash)
+			return
+		}
+		_, err = database.DB.Exec("UPDATE idempotency_keys SET status_code = ?, response = ? WHERE user_id = ? AND key_hash = ?",
+			rec.status, rec.body.Bytes(), userID, keyHash)
+		if err != nil {
+			slog.Error("Failed to store idempotent response", "error", err)
+		}
+	})
+}
+
+// StartIdempotencySweeper deletes expired idempotency keys in the background.
+// Keys are also pruned per user as they send more, but this catches users who
+// stop sending them.
+func StartIdempotencySweeper() {
+	go func() {
+		ticker := time.NewTicker(idempotencySweepInterval)
+		defer ticker.Stop()
+
+		for {
+			sweepIdempotencyKeys()
+			<-ticker.C
+		}
+	}()
+}
+
+// sweepIdempotencyKeys deletes expired keys in batches, so no one delete holds locks for long
+func sweepIdempotencyKeys() {
+	for {
+		result, err := database.DB.Exec("DELETE FROM idempotency_keys WHERE created_at < NOW() - INTERVAL ? SECOND LIMIT ?",
+			int(IdempotencyKeyTTL.Seconds()), idempotencySweepBatch)
+		if err != nil {
+			slog.Warn("Failed to delete expired idempotency keys", "error", err)
+			return
+		}
+		if rowsAffected, _ := result.RowsAffected(); rowsAffected < idempotencySweepBatch {
+			return
+		}
+	}
+}
+
+// replayIdempotent answers a retry with the stored response
+func replayIdempotent(w http.ResponseWriter, userID int, keyHash, requestHash string) {
+	var storedHash string
+	var status sql.NullInt64
+	var response []byte
+	err := database.DB.QueryRow("SELECT request_hash, status_code, response FROM idempotency_keys WHERE user_id = ? AND key_hash = ?", userID, keyHash).
+		Scan(&storedHash, &status, &response)
+	if err != nil {
+		http.Error(w, `{"error": "Failed to process request"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if storedHash != requestHash {
+		http.Error(w, `{"error": "Idempotency-Key was already used for a different request"}`, http.StatusUnprocessableEntity)
+		return
+	}
+	if !status.Valid {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, `{"error": "A request with this Idempotency-Key is still being processed"}`, http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(int(status.Int64))
+	w.Write(response)
+}
+
+// hashRequest identifies a request by its method, path and body
+func hashRequest(r *http.Request, body []byte) string {
+	h := sha256.New()
+	io.WriteString(h, r.Method+" "+r.URL.Path+"\n")
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// responseRecorder passes a response through while keeping a copy of it
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.body.Len() <= maxIdempotentResponse {
+		rec.body.Write(b)
+	}
+	return rec.ResponseWriter.Write(b)
+}
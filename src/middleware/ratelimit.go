@@ -2,9 +2,12 @@ package middleware
 
 import (
 	"fmt"
-	"net"
+	"log/slog"
+	"math"
 	"net/http"
-	"strings"
+	"os"
+	"strconv"
+	"sync"
 	"time"
 
 	"quizzler/cache"
@@ -12,33 +15,43 @@ import (
 
 var RateLimitWindow = time.Minute
 
+// RateLimitPolicy is a token bucket: up to Requests can be made in a burst,
+// and the bucket refills at Requests per Per
+type RateLimitPolicy struct {
+	Requests int
+	Per      time.Duration
+}
+
+func (p RateLimitPolicy) String() string {
+	return fmt.Sprintf("%d/%s", p.Requests, p.Per)
+}
+
+// RateLimit allows maxRequests per RateLimitWindow, see RateLimitWith
 func RateLimit(maxRequests int) func(http.Handler) http.Handler {
+	return RateLimitWith(RateLimitPolicy{Requests: maxRequests, Per: RateLimitWindow})
+}
+
+// RateLimitWith limits requests with a policy. Buckets are per route pattern,
+// so /public-decks/1 and /public-decks/2 share one, and per user when the
+// request is authenticated or per client IP when it isn't.
+func RateLimitWith(policy RateLimitPolicy) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			ip := getClientIP(r)
-			key := fmt.Sprintf("ratelimit:%s:%s", r.URL.Path, ip)
-
-			// Check if rate limiting is available (Redis connected)
-			if !cache.IsAvailable() {
-				// If Redis is not available, allow the request
-				next.ServeHTTP(w, r)
-				return
-			}
-
-			// Get current count
-			count, err := cache.Increment(key, RateLimitWindow)
+			// Falls back to an in-process bucket if Redis is down
+			allowed, remaining, retryAfter, err := cache.TakeToken(cache.RateLimitKey(routeKey(r), policy.String(), rateLimitSubject(r)), policy.Requests, policy.Per)
 			if err != nil {
 				// If there's an error, allow the request
+				slog.Warn("Rate limiter unavailable", "error", err)
 				next.ServeHTTP(w, r)
 				return
 			}
 
 			// Set rate limit headers
-			w.Header().Set("X-RateLimit-Limit", fmt.Sprintf("%d", maxRequests))
-			w.Header().Set("X-RateLimit-Remaining", fmt.Sprintf("%d", max(0, maxRequests-int(count))))
+			w.Header().Set("X-RateLimit-Limit", fmt.Sprintf("%d", policy.Requests))
+			w.Header().Set("X-RateLimit-Remaining", fmt.Sprintf("%d", remaining))
 
-			if int(count) > maxRequests {
-				w.Header().Set("Retry-After", fmt.Sprintf("%d", int(RateLimitWindow.Seconds())))
+			if !allowed {
+				w.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Ceil(retryAfter.Seconds()))))
 				http.Error(w, `{"error": "Too many requests. Please try again later."}`, http.StatusTooManyRequests)
 				return
 			}
@@ -48,25 +61,31 @@ func RateLimit(maxRequests int) func(http.Handler) http.Handler {
 	}
 }
 
-// getClientIP extracts the client IP from the request
-func getClientIP(r *http.Request) string {
-	// Check X-Forwarded-For header (for proxies/load balancers)
-	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		ips := strings.Split(xff, ",")
-		if len(ips) > 0 {
-			return strings.TrimSpace(ips[0])
-		}
+// routeKey identifies the route a request matched, falling back to its path
+func routeKey(r *http.Request) string {
+	if r.Pattern != "" {
+		return r.Pattern
 	}
+	return r.URL.Path
+}
 
-	// Check X-Real-IP header
-	if xri := r.Header.Get("X-Real-IP"); xri != "" {
-		return xri
+func rateLimitSubject(r *http.Request) string {
+	if userID := GetUserID(r); userID != 0 {
+		return fmt.Sprintf("user:%d", userID)
 	}
+	return "ip:" + ClientIP(r)
+}
 
-	// Fall back to RemoteAddr
-	ip, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		return r.RemoteAddr
+// authRateLimitPolicy is applied to every authenticated route, per user, from
+// AUTH_RATE_LIMIT requests per minute
+var authRateLimitPolicy = sync.OnceValue(func() RateLimitPolicy {
+	requests := 300
+	if value := os.Getenv("AUTH_RATE_LIMIT"); value != "" {
+		if n, err := strconv.Atoi(value); err == nil && n > 0 {
+			requests = n
+		} else {
+			slog.Warn("Invalid AUTH_RATE_LIMIT, using default", "value", value, "default", requests)
+		}
 	}
-	return ip
-}
+	return RateLimitPolicy{Requests: requests, Per: time.Minute}
+})
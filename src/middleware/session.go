@@ -0,0 +1,69 @@
+package middleware
+
+import (
+	"database/sql"
+	"errors"
+	"log/slog"
+	"time"
+
+	"quizzler/cache"
+	"quizzler/database"
+)
+
+const (
+	sessionActive  = "active"
+	sessionRevoked = "revoked"
+
+	// How long an active session status is cached, which also bounds how
+	// often last_seen_at is written
+	sessionCacheTTL = time.Minute
+)
+
+// isSessionActive reports whether the login session for a refresh token
+// family is still active, checking Redis before falling back to the database
+func isSessionActive(familyID string) bool {
+	if familyID == "" {
+		return false
+	}
+
+	key := cache.SessionKey(familyID)
+	// Only Redis is shared between servers, so the in-memory cache could miss a revocation
+	redisUp := cache.IsAvailable()
+	if redisUp {
+		var status string
+		if err := cache.Get(key, &status); err == nil {
+			return status == sessionActive
+		}
+	}
+
+	var revokedAt sql.NullTime
+	err := database.DB.QueryRow("SELECT revoked_at FROM sessions WHERE family_id = ?", familyID).Scan(&revokedAt)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			slog.Error("Failed to look up session", "error", err)
+		}
+		return false
+	}
+
+	status := sessionActive
+	ttl := sessionCacheTTL
+	if revokedAt.Valid {
+		status = sessionRevoked
+		ttl = AccessTokenTTL()
+	} else {
+		database.DB.Exec("UPDATE sessions SET last_seen_at = NOW() WHERE family_id = ?", familyID)
+	}
+
+	if redisUp {
+		cache.SetWithTTL(key, status, ttl)
+	}
+	return status == sessionActive
+}
+
+// MarkSessionRevoked records a revoked session in the cache so that access
+// tokens issued for it are rejected straight away rather than after the cache
+// expires. While Redis is down this only reaches the in-memory cache, and
+// Redis's copy is deleted when it's back.
+func MarkSessionRevoked(familyID string) {
+	cache.SetWithTTL(cache.SessionKey(familyID), sessionRevoked, AccessTokenTTL())
+}
@@ -3,11 +3,15 @@ package models
 import "time"
 
 type User struct {
-	ID        int       `json:"id"`
-	Email     string    `json:"email"`
-	Password  string    `json:"-"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID               int       `json:"id"`
+	Email            string    `json:"email"`
+	Password         string    `json:"-"`
+	EmailVerified    bool      `json:"email_verified"`
+	TwoFactorEnabled bool      `json:"two_factor_enabled"`
+	Admin            bool      `json:"admin"`
+	Active           bool      `json:"active"`
+	CreatedAt        time.Time `json:"created_at"`
+	UpdatedAt        time.Time `json:"updated_at"`
 }
 
 type Deck struct {
@@ -17,6 +21,7 @@ type Deck struct {
 	Description string    `json:"description"`
 	Public      bool      `json:"public"`
 	CardCount   int       `json:"card_count"`
+	Version     int       `json:"version"`
 	CreatedAt   time.Time `json:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at"`
 }
@@ -26,6 +31,8 @@ type Card struct {
 	DeckID    int       `json:"deck_id"`
 	Front     string    `json:"front"`
 	Back      string    `json:"back"`
+	Tags      []string  `json:"tags,omitempty"`
+	Version   int       `json:"version"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 }
@@ -34,16 +41,204 @@ type Card struct {
 type LoginRequest struct {
 	Email    string `json:"email"`
 	Password string `json:"password"`
+	Device   string `json:"device,omitempty"`
 }
 
 type RegisterRequest struct {
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	Email      string `json:"email"`
+	Password   string `json:"password"`
+	Device     string `json:"device,omitempty"`
+	InviteCode string `json:"invite_code,omitempty"`
+}
+
+type RegistrationConfigResponse struct {
+	Mode    string   `json:"mode"`
+	Domains []string `json:"domains,omitempty"`
 }
 
 type AuthResponse struct {
+	Token                string `json:"token,omitempty"`
+	RefreshToken         string `json:"refresh_token,omitempty"`
+	ExpiresIn            int    `json:"expires_in,omitempty"`
+	User                 User   `json:"user"`
+	VerificationRequired bool   `json:"verification_required,omitempty"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type TokenResponse struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+type EmailRequest struct {
+	Email string `json:"email"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+type VerifyEmailRequest struct {
 	Token string `json:"token"`
-	User  User   `json:"user"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+type ChangeEmailRequest struct {
+	Email           string `json:"email"`
+	CurrentPassword string `json:"current_password"`
+}
+
+type TwoFactorChallengeResponse struct {
+	TwoFactorRequired bool   `json:"two_factor_required"`
+	ChallengeToken    string `json:"challenge_token"`
+	ExpiresIn         int    `json:"expires_in"`
+}
+
+type LoginTwoFactorRequest struct {
+	ChallengeToken string `json:"challenge_token"`
+	Code           string `json:"code"`
+}
+
+type TwoFactorSetupResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+	QRCode string `json:"qr_code"`
+}
+
+type TwoFactorSetupRequest struct {
+	CurrentPassword string `json:"current_password"`
+}
+
+type TwoFactorCodeRequest struct {
+	Code string `json:"code"`
+}
+
+type EnableTwoFactorRequest struct {
+	CurrentPassword string `json:"current_password"`
+	Code            string `json:"code"`
+}
+
+type DisableTwoFactorRequest struct {
+	CurrentPassword string `json:"current_password"`
+	Code            string `json:"code"`
+}
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type SSOConfigResponse struct {
+	Enabled bool   `json:"enabled"`
+	Name    string `json:"name,omitempty"`
+}
+
+type SSOExchangeRequest struct {
+	Token  string `json:"token"`
+	Device string `json:"device,omitempty"`
+}
+
+type APIToken struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+type CreateAPITokenRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+type CreateAPITokenResponse struct {
+	APIToken
+	Token string `json:"token"`
+}
+
+type AdminUser struct {
+	User
+	DeckCount int `json:"deck_count"`
+}
+
+type AdminUserList struct {
+	Users []AdminUser `json:"users"`
+	Total int         `json:"total"`
+}
+
+type UpdateUserRequest struct {
+	Admin  *bool `json:"admin,omitempty"`
+	Active *bool `json:"active,omitempty"`
+}
+
+type InstanceStats struct {
+	Users       int        `json:"users"`
+	ActiveUsers int        `json:"active_users"`
+	Admins      int        `json:"admins"`
+	Decks       int        `json:"decks"`
+	PublicDecks int        `json:"public_decks"`
+	Cards       int        `json:"cards"`
+	Cache       CacheStats `json:"cache"`
+}
+
+type CacheStats struct {
+	Backend       string `json:"backend"`
+	RedisHealthy  bool   `json:"redis_healthy"`
+	Hits          int64  `json:"hits"`
+	Misses        int64  `json:"misses"`
+	Fallbacks     int64  `json:"fallbacks"`
+	MemoryEntries int    `json:"memory_entries"`
+	MemoryBuckets int    `json:"memory_buckets"`
+}
+
+type Invite struct {
+	ID        int        `json:"id"`
+	Note      string     `json:"note"`
+	MaxUses   int        `json:"max_uses"`
+	Uses      int        `json:"uses"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+type CreateInviteRequest struct {
+	Note      string     `json:"note"`
+	MaxUses   int        `json:"max_uses"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+type CreateInviteResponse struct {
+	Invite
+	Code string `json:"code"`
+}
+
+type AuditEvent struct {
+	ID        int       `json:"id"`
+	UserID    *int      `json:"user_id"`
+	Event     string    `json:"event"`
+	Detail    string    `json:"detail"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type Session struct {
+	ID         int       `json:"id"`
+	Device     string    `json:"device"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	Current    bool      `json:"current"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
 }
 
 // Decks
@@ -57,23 +252,89 @@ type UpdateDeckRequest struct {
 	Name        string `json:"name"`
 	Description string `json:"description"`
 	Public      bool   `json:"public"`
+	// The version being edited, required unless If-Match is sent
+	Version *int `json:"version"`
 }
 
 // Cards
 type CreateCardRequest struct {
-	Front string `json:"front"`
-	Back  string `json:"back"`
+	Front      string `json:"front"`
+	Back       string `json:"back"`
+	Duplicates string `json:"duplicates,omitempty"`
 }
 
 type UpdateCardRequest struct {
 	Front string `json:"front"`
 	Back  string `json:"back"`
+	// The version being edited, required unless If-Match is sent
+	Version *int `json:"version"`
+}
+
+// ConflictResponse is returned with 409 when an update was based on an old
+// version, carrying the current copy so the client can merge
+type ConflictResponse struct {
+	Error   string `json:"error"`
+	Current any    `json:"current"`
 }
 
 type ImportCardsRequest struct {
-	Cards []CreateCardRequest `json:"cards"`
+	Cards      []CreateCardRequest `json:"cards"`
+	Duplicates string              `json:"duplicates,omitempty"`
 }
 
 type ImportCardsResponse struct {
 	Imported int `json:"imported"`
+	Updated  int `json:"updated"`
+	Skipped  int `json:"skipped"`
+}
+
+type ImportNotesResponse struct {
+	DecksCreated int `json:"decks_created"`
+	Imported     int `json:"imported"`
+	Updated      int `json:"updated"`
+	Skipped      int `json:"skipped"`
+}
+
+// DuplicateGroup is a set of cards in a deck sharing the same normalized front
+type DuplicateGroup struct {
+	FrontHash string `json:"front_hash"`
+	Cards     []Card `json:"cards"`
+}
+
+// Backup archives are ZIP files containing a single backup.json document.
+// Version is bumped whenever a field is removed or changes meaning; new
+// optional fields may be added without a bump. IDs are only meaningful
+// within the archive and are remapped on restore.
+const BackupVersion = 1
+
+type Backup struct {
+	Version    int          `json:"version"`
+	ExportedAt time.Time    `json:"exported_at"`
+	Email      string       `json:"email"`
+	Decks      []BackupDeck `json:"decks"`
+}
+
+type BackupDeck struct {
+	ID          int          `json:"id"`
+	Name        string       `json:"name"`
+	Description string       `json:"description"`
+	Public      bool         `json:"public"`
+	CreatedAt   time.Time    `json:"created_at"`
+	UpdatedAt   time.Time    `json:"updated_at"`
+	Cards       []BackupCard `json:"cards"`
+}
+
+type BackupCard struct {
+	ID        int       `json:"id"`
+	Front     string    `json:"front"`
+	Back      string    `json:"back"`
+	Tags      []string  `json:"tags,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type RestoreResponse struct {
+	Decks   int         `json:"decks"`
+	Cards   int         `json:"cards"`
+	DeckIDs map[int]int `json:"deck_ids"`
 }
@@ -0,0 +1,220 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config describes the OpenID Connect provider used for single sign-on
+type Config struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	Name         string
+}
+
+// Metadata is the subset of the provider's discovery document we use
+type Metadata struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	JWKSURI               string   `json:"jwks_uri"`
+	CodeChallengeMethods  []string `json:"code_challenge_methods_supported"`
+}
+
+// Provider is a configured OpenID Connect provider. Its discovery document
+// is fetched on first use, so the IdP doesn't need to be up at startup.
+type Provider struct {
+	Config Config
+	client *http.Client
+
+	mu       sync.Mutex
+	metadata *Metadata
+	keys     *keySet
+}
+
+var ErrInvalidToken = errors.New("invalid ID token")
+
+var current *Provider
+
+// Init configures single sign-on from the OIDC_* variables. It is disabled
+// if OIDC_ISSUER is empty.
+func Init() error {
+	issuer := getEnv("OIDC_ISSUER", "")
+	if issuer == "" {
+		return nil
+	}
+
+	cfg := Config{
+		Issuer:       strings.TrimSuffix(issuer, "/"),
+		ClientID:     getEnv("OIDC_CLIENT_ID", ""),
+		ClientSecret: getEnv("OIDC_CLIENT_SECRET", ""),
+		RedirectURL:  getEnv("OIDC_REDIRECT_URL", getEnv("APP_URL", "http://127.0.0.1:5172")+"/api/auth/oidc/callback"),
+		Scopes:       strings.Fields(getEnv("OIDC_SCOPES", "openid email profile")),
+		Name:         getEnv("OIDC_NAME", "Single sign-on"),
+	}
+	if cfg.ClientID == "" {
+		return errors.New("OIDC_CLIENT_ID is required when OIDC_ISSUER is set")
+	}
+
+	current = NewProvider(cfg)
+	slog.Info("Single sign-on configured", "issuer", cfg.Issuer)
+	return nil
+}
+
+// NewProvider creates a provider for a config
+func NewProvider(cfg Config) *Provider {
+	return &Provider{
+		Config: cfg,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Current returns the configured provider, or nil if single sign-on is disabled
+func Current() *Provider {
+	return current
+}
+
+// Discover returns the provider's metadata, fetching it the first time
+func (p *Provider) Discover(ctx context.Context) (*Metadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.metadata != nil {
+		return p.metadata, nil
+	}
+
+	var m Metadata
+	if err := p.getJSON(ctx, p.Config.Issuer+"/.well-known/openid-configuration", &m); err != nil {
+		return nil, fmt.Errorf("discovery: %w", err)
+	}
+	if strings.TrimSuffix(m.Issuer, "/") != p.Config.Issuer {
+		return nil, fmt.Errorf("discovery: issuer %q does not match %q", m.Issuer, p.Config.Issuer)
+	}
+	if m.AuthorizationEndpoint == "" || m.TokenEndpoint == "" || m.JWKSURI == "" {
+		return nil, errors.New("discovery: missing endpoints")
+	}
+	if len(m.CodeChallengeMethods) > 0 && !slices.Contains(m.CodeChallengeMethods, "S256") {
+		return nil, errors.New("discovery: provider does not support PKCE with S256")
+	}
+
+	p.metadata = &m
+	p.keys = newKeySet(p, m.JWKSURI)
+	return p.metadata, nil
+}
+
+// AuthCodeURL builds the URL to send the user to, using PKCE with the S256 method
+func (p *Provider) AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	m, err := p.Discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.Config.ClientID},
+		"redirect_uri":          {p.Config.RedirectURL},
+		"scope":                 {strings.Join(p.Config.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {CodeChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+
+	sep := "?"
+	if strings.Contains(m.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return m.AuthorizationEndpoint + sep + q.Encode(), nil
+}
+
+// Exchange redeems an authorization code and returns the verified ID token claims
+func (p *Provider) Exchange(ctx context.Context, code, verifier, nonce string) (*Claims, error) {
+	m, err := p.Discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.Config.RedirectURL},
+		"client_id":     {p.Config.ClientID},
+		"code_verifier": {verifier},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.Config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.Config.ClientID), url.QueryEscape(p.Config.ClientSecret))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("token exchange: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("token exchange: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token exchange: status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.Unmarshal(body, &tokens); err != nil {
+		return nil, fmt.Errorf("token exchange: %w", err)
+	}
+	if tokens.IDToken == "" {
+		return nil, errors.New("token exchange: no id_token in response")
+	}
+
+	return p.VerifyIDToken(ctx, tokens.IDToken, nonce)
+}
+
+func (p *Provider) getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: status %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
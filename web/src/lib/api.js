@@ -1,7 +1,30 @@
-import { token, user, logout } from './stores.js';
+import { token, refreshToken, logout, setSession } from './stores.js';
 import { get } from 'svelte/store';
 
-export async function api(endpoint, options = {}) {
+let refreshing = null;
+
+// Exchange the refresh token for a new access token, sharing one request between concurrent callers
+function refreshSession() {
+  if (!refreshing) {
+    refreshing = (async () => {
+      const currentRefreshToken = get(refreshToken);
+      if (!currentRefreshToken) return false;
+      const response = await fetch('/api/token/refresh', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ refresh_token: currentRefreshToken }),
+      });
+      if (!response.ok) return false;
+      setSession(await response.json());
+      return true;
+    })().finally(() => {
+      refreshing = null;
+    });
+  }
+  return refreshing;
+}
+
+export async function api(endpoint, options = {}, retry = true) {
   const currentToken = get(token);
   const headers = {
     'Content-Type': 'application/json',
@@ -21,15 +44,21 @@ export async function api(endpoint, options = {}) {
   const data = await response.json();
 
   if (response.status === 401) {
-    // Only logout if we had a token (session expired)
+    // Only logout if we had a token (session expired) and it can't be refreshed
     if (currentToken) {
+      if (retry && (await refreshSession())) {
+        return api(endpoint, options, false);
+      }
       logout();
     }
     throw new Error(data.error || 'Unauthorized');
   }
 
   if (!response.ok) {
-    throw new Error(data.error || 'Something went wrong');
+    const error = new Error(data.error || 'Something went wrong');
+    error.status = response.status;
+    error.data = data;
+    throw error;
   }
 
   return data;
@@ -40,25 +69,62 @@ export async function login(email, password) {
     method: 'POST',
     body: { email, password },
   });
-  token.set(data.token);
-  user.set(data.user);
-  localStorage.setItem('token', data.token);
-  localStorage.setItem('user', JSON.stringify(data.user));
+  // Accounts with two-factor authentication need a second step, see loginTwoFactor
+  if (!data.two_factor_required) {
+    setSession(data);
+  }
   return data;
 }
 
-export async function register(email, password) {
+export async function loginTwoFactor(challengeToken, code) {
+  const data = await api('/login/2fa', {
+    method: 'POST',
+    body: { challenge_token: challengeToken, code },
+  });
+  setSession(data);
+  return data;
+}
+
+export async function getSSOConfig() {
+  return api('/auth/oidc');
+}
+
+// Exchange the code the single sign-on callback left in the URL fragment for a session
+export async function exchangeSSOToken(ssoToken) {
+  const data = await api('/auth/oidc/exchange', {
+    method: 'POST',
+    body: { token: ssoToken },
+  });
+  if (!data.two_factor_required) {
+    setSession(data);
+  }
+  return data;
+}
+
+export async function getRegistrationConfig() {
+  return api('/register');
+}
+
+export async function register(email, password, inviteCode = '') {
   const data = await api('/register', {
     method: 'POST',
-    body: { email, password },
+    body: { email, password, ...(inviteCode && { invite_code: inviteCode }) },
   });
-  token.set(data.token);
-  user.set(data.user);
-  localStorage.setItem('token', data.token);
-  localStorage.setItem('user', JSON.stringify(data.user));
+  if (data.token) {
+    setSession(data);
+  }
   return data;
 }
 
+export async function signOut() {
+  try {
+    await api('/logout', { method: 'POST' }, false);
+  } catch (err) {
+    // The session is cleared locally either way
+  }
+  logout();
+}
+
 // Decks
 export const getDecks = () => api('/decks');
 export const getDeck = (id) => api(`/decks/${id}`);
@@ -80,8 +146,8 @@ export const getPublicDeckCards = async (id) => {
 };
 export const createDeck = (name, description, isPublic = false) =>
   api('/decks', { method: 'POST', body: { name, description, public: isPublic } });
-export const updateDeck = (id, name, description, isPublic = false) =>
-  api(`/decks/${id}`, { method: 'PUT', body: { name, description, public: isPublic } });
+export const updateDeck = (id, name, description, isPublic = false, version) =>
+  api(`/decks/${id}`, { method: 'PUT', body: { name, description, public: isPublic, version } });
 export const deleteDeck = (id) => api(`/decks/${id}`, { method: 'DELETE' });
 
 // Cards
@@ -89,9 +155,10 @@ export const getCards = (deckId) => api(`/decks/${deckId}/cards`);
 export const getCard = (id) => api(`/cards/${id}`);
 export const createCard = (deckId, front, back) =>
   api(`/decks/${deckId}/cards`, { method: 'POST', body: { front, back } });
-export const updateCard = (id, front, back) =>
-  api(`/cards/${id}`, { method: 'PUT', body: { front, back } });
+export const updateCard = (id, front, back, version) =>
+  api(`/cards/${id}`, { method: 'PUT', body: { front, back, version } });
 export const deleteCard = (id) => api(`/cards/${id}`, { method: 'DELETE' });
-export const importCards = (deckId, cards) =>
-  api(`/decks/${deckId}/cards/import`, { method: 'POST', body: { cards } });
+export const importCards = (deckId, cards, duplicates = 'skip') =>
+  api(`/decks/${deckId}/cards/import`, { method: 'POST', body: { cards, duplicates } });
+export const getDuplicates = (deckId) => api(`/decks/${deckId}/duplicates`);
 
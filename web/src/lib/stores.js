@@ -2,9 +2,11 @@ import { writable } from 'svelte/store';
 
 // Initialize from localStorage
 const storedToken = localStorage.getItem('token');
+const storedRefreshToken = localStorage.getItem('refreshToken');
 const storedUser = JSON.parse(localStorage.getItem('user') || 'null');
 
 export const token = writable(storedToken);
+export const refreshToken = writable(storedRefreshToken);
 export const user = writable(storedUser);
 export const isAuthenticated = writable(!!storedToken);
 
@@ -13,10 +15,23 @@ token.subscribe((value) => {
   isAuthenticated.set(!!value);
 });
 
+export function setSession(data) {
+  token.set(data.token);
+  refreshToken.set(data.refresh_token);
+  localStorage.setItem('token', data.token);
+  localStorage.setItem('refreshToken', data.refresh_token);
+  if (data.user) {
+    user.set(data.user);
+    localStorage.setItem('user', JSON.stringify(data.user));
+  }
+}
+
 export function logout() {
   token.set(null);
+  refreshToken.set(null);
   user.set(null);
   localStorage.removeItem('token');
+  localStorage.removeItem('refreshToken');
   localStorage.removeItem('user');
 }
 